@@ -0,0 +1,41 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "testing"
+
+func TestParseShmSize(t *testing.T) {
+	size, ok, err := ParseShmSize(map[string]string{ShmSizeAnnotation: "256Mi"}, 0)
+	if err != nil || !ok {
+		t.Fatalf("ParseShmSize: ok=%v err=%v", ok, err)
+	}
+	if size != 256*1024*1024 {
+		t.Fatalf("expected 256Mi in bytes, got %d", size)
+	}
+
+	if _, ok, err := ParseShmSize(map[string]string{}, 0); ok || err != nil {
+		t.Fatalf("expected ok=false, err=nil for missing annotation, got ok=%v err=%v", ok, err)
+	}
+
+	if _, _, err := ParseShmSize(map[string]string{ShmSizeAnnotation: "not-a-size"}, 0); err == nil {
+		t.Fatal("expected error for unparseable value")
+	}
+
+	if _, _, err := ParseShmSize(map[string]string{ShmSizeAnnotation: "1Gi"}, 64*1024*1024); err == nil {
+		t.Fatal("expected error when value exceeds configured maximum")
+	}
+}
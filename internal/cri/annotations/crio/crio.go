@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package crio defines the io.kubernetes.cri-o.* annotation keys that
+// tools such as Falco and other node agents read directly off the OCI
+// runtime spec to discover pod/container identity. When the CRI plugin's
+// compatibility mode is enabled, it duplicates its own io.kubernetes.cri.*
+// and io.cri-containerd.* values onto a spec under these canonical keys so
+// such tools work unmodified against containerd.
+package crio
+
+const (
+	// ContainerType is the CRI-O annotation key for container type
+	// ("sandbox" or "container").
+	ContainerType = "io.kubernetes.cri-o.ContainerType"
+	// ContainerName is the CRI-O annotation key for container name.
+	ContainerName = "io.kubernetes.cri-o.ContainerName"
+	// ContainerID is the CRI-O annotation key for container ID.
+	ContainerID = "io.kubernetes.cri-o.ContainerID"
+	// SandboxName is the CRI-O annotation key for sandbox name.
+	SandboxName = "io.kubernetes.cri-o.SandboxName"
+	// SandboxID is the CRI-O annotation key for sandbox ID.
+	SandboxID = "io.kubernetes.cri-o.SandboxID"
+	// ImageName is the CRI-O annotation key for image name.
+	ImageName = "io.kubernetes.cri-o.ImageName"
+	// ImageRef is the CRI-O annotation key for image reference.
+	ImageRef = "io.kubernetes.cri-o.ImageRef"
+	// LogPath is the CRI-O annotation key for container log path.
+	LogPath = "io.kubernetes.cri-o.LogPath"
+	// Metadata is the CRI-O annotation key for the JSON-encoded CRI
+	// metadata of the sandbox or container.
+	Metadata = "io.kubernetes.cri-o.Metadata"
+	// Namespace is the CRI-O annotation key for the Kubernetes namespace.
+	Namespace = "io.kubernetes.cri-o.Namespace"
+	// Labels is the CRI-O annotation key for the JSON-encoded CRI labels.
+	Labels = "io.kubernetes.cri-o.Labels"
+	// Annotations is the CRI-O annotation key for the JSON-encoded CRI
+	// annotations.
+	Annotations = "io.kubernetes.cri-o.Annotations"
+)
+
+// Source maps the subset of a generated spec's canonical io.kubernetes.cri.*
+// / io.cri-containerd.* annotations that have a CRI-O equivalent onto their
+// CRI-O keys above. Callers build this from whatever canonical values they
+// already computed for the spec; Mirror does not read containerd-specific
+// state itself so it has no dependency on the spec-generation code this
+// repository snapshot doesn't contain.
+type Source struct {
+	ContainerType string
+	ContainerName string
+	ContainerID   string
+	SandboxName   string
+	SandboxID     string
+	ImageName     string
+	ImageRef      string
+	LogPath       string
+	Metadata      string
+	Namespace     string
+	Labels        string
+	Annotations   string
+}
+
+// Mirror returns src's non-empty fields as a map keyed by the matching
+// CRI-O annotation constant, ready to be merged into a generated spec's
+// Annotations when compatibility mode is enabled.
+func Mirror(src Source) map[string]string {
+	out := make(map[string]string)
+	add := func(key, value string) {
+		if value != "" {
+			out[key] = value
+		}
+	}
+
+	add(ContainerType, src.ContainerType)
+	add(ContainerName, src.ContainerName)
+	add(ContainerID, src.ContainerID)
+	add(SandboxName, src.SandboxName)
+	add(SandboxID, src.SandboxID)
+	add(ImageName, src.ImageName)
+	add(ImageRef, src.ImageRef)
+	add(LogPath, src.LogPath)
+	add(Metadata, src.Metadata)
+	add(Namespace, src.Namespace)
+	add(Labels, src.Labels)
+	add(Annotations, src.Annotations)
+
+	return out
+}
@@ -0,0 +1,36 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package crio
+
+import "testing"
+
+func TestMirror(t *testing.T) {
+	out := Mirror(Source{
+		ContainerType: "container",
+		ContainerID:   "abc123",
+	})
+
+	if out[ContainerType] != "container" || out[ContainerID] != "abc123" {
+		t.Fatalf("unexpected mirrored annotations: %+v", out)
+	}
+	if _, ok := out[SandboxID]; ok {
+		t.Fatalf("expected empty fields to be omitted, got %+v", out)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected exactly 2 mirrored keys, got %d: %+v", len(out), out)
+	}
+}
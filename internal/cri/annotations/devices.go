@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DevicesAnnotation injects host devices into a container without a
+// privileged pod or a DevicePlugin. Its value is a comma-separated list of
+// "hostPath:containerPath:cgroupPerms" entries, e.g.
+// "/dev/fuse:/dev/fuse:rwm,/dev/net/tun::rwm" (an empty containerPath
+// reuses hostPath). Mirrors CRI-O's DevicesAnnotation.
+const DevicesAnnotation = "io.kubernetes.cri.devices"
+
+// DeviceMapping is one parsed entry from DevicesAnnotation.
+type DeviceMapping struct {
+	HostPath      string
+	ContainerPath string
+	// CgroupPermissions is some combination of 'r' (read), 'w' (write) and
+	// 'm' (mknod), matching the OCI spec's LinuxDeviceCgroup.Access.
+	CgroupPermissions string
+}
+
+// ParseDevices parses DevicesAnnotation's value, rejecting any entry whose
+// hostPath doesn't match one of allowPatterns (shell glob patterns, see
+// path.Match). An empty allowPatterns rejects every entry, since the
+// feature defaults off: operators must opt a pattern in before any
+// annotation-driven device injection is honored.
+func ParseDevices(value string, allowPatterns []string) ([]DeviceMapping, error) {
+	var mappings []DeviceMapping
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid %s entry %q: expected hostPath:containerPath:cgroupPerms", DevicesAnnotation, entry)
+		}
+
+		hostPath, containerPath, perms := parts[0], parts[1], parts[2]
+		if hostPath == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: hostPath is required", DevicesAnnotation, entry)
+		}
+		if containerPath == "" {
+			containerPath = hostPath
+		}
+		if err := validateCgroupPermissions(perms); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", DevicesAnnotation, entry, err)
+		}
+
+		if !matchesAny(hostPath, allowPatterns) {
+			return nil, fmt.Errorf("%s: device %q is not allowed by the configured allowlist", DevicesAnnotation, hostPath)
+		}
+
+		mappings = append(mappings, DeviceMapping{
+			HostPath:          hostPath,
+			ContainerPath:     containerPath,
+			CgroupPermissions: perms,
+		})
+	}
+	return mappings, nil
+}
+
+// validateCgroupPermissions rejects anything but a combination of 'r', 'w'
+// and 'm', each appearing at most once.
+func validateCgroupPermissions(perms string) error {
+	if perms == "" {
+		return fmt.Errorf("cgroup permissions are required")
+	}
+	seen := make(map[rune]bool)
+	for _, c := range perms {
+		if c != 'r' && c != 'w' && c != 'm' {
+			return fmt.Errorf("cgroup permissions %q: unsupported rune %q, only 'r', 'w', 'm' are allowed", perms, c)
+		}
+		if seen[c] {
+			return fmt.Errorf("cgroup permissions %q: %q repeated", perms, c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "testing"
+
+func TestParseDevices(t *testing.T) {
+	value := "/dev/fuse:/dev/fuse:rwm,/dev/net/tun::rwm"
+	mappings, err := ParseDevices(value, []string{"/dev/fuse", "/dev/net/*"})
+	if err != nil {
+		t.Fatalf("ParseDevices: %v", err)
+	}
+	if len(mappings) != 2 {
+		t.Fatalf("expected 2 device mappings, got %d", len(mappings))
+	}
+	if mappings[1].ContainerPath != "/dev/net/tun" {
+		t.Fatalf("expected empty containerPath to default to hostPath, got %+v", mappings[1])
+	}
+
+	if _, err := ParseDevices("/dev/kmsg:/dev/kmsg:rwm", []string{"/dev/fuse"}); err == nil {
+		t.Fatal("expected error for device outside allowlist")
+	}
+	if _, err := ParseDevices("/dev/fuse:/dev/fuse:rx", []string{"/dev/fuse"}); err == nil {
+		t.Fatal("expected error for invalid cgroup permissions")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "fmt"
+
+// disableValue is the only value the low-latency annotations below accept;
+// anything else is rejected rather than treated as a no-op, so a typo in
+// the annotation doesn't silently leave a workload load-balanced.
+const disableValue = "disable"
+
+// CPULoadBalancingAnnotation, when set to "disable", asks the CRI plugin to
+// clear SCHED_LOAD_BALANCE on the cpuset cgroup created for the container's
+// exclusive CPUs. Modeled on CRI-O's cpu-load-balancing.crio.io.
+const CPULoadBalancingAnnotation = "io.kubernetes.cri.cpu-load-balancing"
+
+// CPUQuotaAnnotation, when set to "disable", asks the CRI plugin to omit
+// cpu.cfs_quota_us/cpu.max for the container so its exclusive CPUs are never
+// throttled. Modeled on CRI-O's cpu-quota.crio.io.
+const CPUQuotaAnnotation = "io.kubernetes.cri.cpu-quota"
+
+// IRQLoadBalancingAnnotation, when set to "disable", asks the CRI plugin to
+// exclude the container's exclusive CPUs from servicing IRQs, via whatever
+// IRQBalancer is configured. Modeled on CRI-O's irq-load-balancing.crio.io.
+const IRQLoadBalancingAnnotation = "io.kubernetes.cri.irq-load-balancing"
+
+// ValidateLatencyAnnotations checks the three low-latency annotations on
+// podAnnotations against the constraints the CRI plugin must enforce before
+// honoring them: they are only meaningful for a Guaranteed-QoS pod with an
+// integer CPU request, since a shared/fractional CPU can't be pulled out of
+// load balancing without affecting other workloads on the same core. It
+// returns the subset of the three keys present with value "disable", or an
+// error if any of them is set on a pod that doesn't qualify, or set to a
+// value other than "disable".
+func ValidateLatencyAnnotations(podAnnotations map[string]string, guaranteedQoS, integerCPURequest bool) (map[string]string, error) {
+	keys := []string{CPULoadBalancingAnnotation, CPUQuotaAnnotation, IRQLoadBalancingAnnotation}
+
+	disabled := make(map[string]string)
+	for _, k := range keys {
+		v, ok := podAnnotations[k]
+		if !ok {
+			continue
+		}
+		if v != disableValue {
+			return nil, fmt.Errorf("annotation %s: unsupported value %q, only %q is accepted", k, v, disableValue)
+		}
+		if !guaranteedQoS || !integerCPURequest {
+			return nil, fmt.Errorf("annotation %s is only valid for a Guaranteed-QoS pod with an integer CPU request", k)
+		}
+		disabled[k] = v
+	}
+
+	return disabled, nil
+}
+
+// IRQBalancer excludes a container's exclusive CPUs from IRQ servicing, and
+// reverts that exclusion once the container no longer holds them. It is the
+// extension point IRQLoadBalancingAnnotation handling is meant to call
+// through, so operators can back it with irqbalance, tuned, or a
+// site-specific mechanism instead of the CRI plugin hard-coding one.
+type IRQBalancer interface {
+	// Exclude removes cpus (a Linux CPU list, e.g. "4-7,12") from IRQ
+	// balancing, typically by updating /proc/irq/default_smp_affinity or
+	// signaling a running balancer daemon to do so.
+	Exclude(cpus string) error
+
+	// Restore reverses a prior Exclude for cpus once the container
+	// releases them.
+	Restore(cpus string) error
+}
@@ -0,0 +1,41 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "testing"
+
+func TestValidateLatencyAnnotations(t *testing.T) {
+	podAnnotations := map[string]string{CPULoadBalancingAnnotation: "disable"}
+
+	disabled, err := ValidateLatencyAnnotations(podAnnotations, true, true)
+	if err != nil {
+		t.Fatalf("ValidateLatencyAnnotations: %v", err)
+	}
+	if disabled[CPULoadBalancingAnnotation] != "disable" {
+		t.Fatalf("expected annotation to be reported as disabled, got %+v", disabled)
+	}
+
+	if _, err := ValidateLatencyAnnotations(podAnnotations, false, true); err == nil {
+		t.Fatal("expected error for non-Guaranteed-QoS pod")
+	}
+	if _, err := ValidateLatencyAnnotations(podAnnotations, true, false); err == nil {
+		t.Fatal("expected error for non-integer CPU request")
+	}
+	if _, err := ValidateLatencyAnnotations(map[string]string{CPUQuotaAnnotation: "on"}, true, true); err == nil {
+		t.Fatal("expected error for unsupported annotation value")
+	}
+}
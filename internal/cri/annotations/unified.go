@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// UnifiedCgroupAnnotation carries a newline-separated list of
+// "cgroup.file=value" pairs (e.g. "memory.swap.max=0") to inject into the
+// OCI spec's LinuxResources.Unified. Modeled on CRI-O's UnifiedCgroup.
+const UnifiedCgroupAnnotation = "io.kubernetes.cri.unified"
+
+// Cgroup2RWAnnotation, when set to "true", asks the CRI plugin to remount
+// the container's /sys/fs/cgroup mount rw, for workloads that manage their
+// own cgroup subtree.
+const Cgroup2RWAnnotation = "io.kubernetes.cri.cgroup2-rw"
+
+// ParseUnifiedCgroup parses UnifiedCgroupAnnotation's value into the
+// cgroup.file -> value pairs it names, rejecting any file not matched by
+// one of allowPatterns (shell glob patterns, matched with path.Match
+// against the cgroup file name). An empty allowPatterns rejects every file,
+// since the annotation is opt-in per deployment. Callers on a cgroupv1 host
+// must reject the annotation outright before calling this, since
+// LinuxResources.Unified has no cgroupv1 equivalent.
+func ParseUnifiedCgroup(value string, allowPatterns []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid %s entry %q: expected cgroup.file=value", UnifiedCgroupAnnotation, line)
+		}
+		file, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		if !matchesAny(file, allowPatterns) {
+			return nil, fmt.Errorf("%s: cgroup file %q is not allowed by the configured allowlist", UnifiedCgroupAnnotation, file)
+		}
+
+		result[file] = val
+	}
+	return result, nil
+}
+
+// matchesAny reports whether name matches any of patterns, evaluated as
+// path.Match shell glob patterns.
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
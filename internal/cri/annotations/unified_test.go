@@ -0,0 +1,37 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "testing"
+
+func TestParseUnifiedCgroup(t *testing.T) {
+	value := "memory.swap.max=0\nio.latency=default rbps=1048576"
+	result, err := ParseUnifiedCgroup(value, []string{"memory.*", "io.*"})
+	if err != nil {
+		t.Fatalf("ParseUnifiedCgroup: %v", err)
+	}
+	if result["memory.swap.max"] != "0" {
+		t.Fatalf("unexpected parse result: %+v", result)
+	}
+
+	if _, err := ParseUnifiedCgroup("cpu.shares=100", []string{"memory.*"}); err == nil {
+		t.Fatal("expected error for file not matched by allowlist")
+	}
+	if _, err := ParseUnifiedCgroup("not-a-pair", []string{"*"}); err == nil {
+		t.Fatal("expected error for malformed entry")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package annotations
+
+import "testing"
+
+func TestParseUsernsMode(t *testing.T) {
+	mode, err := ParseUsernsMode("keep-id")
+	if err != nil || !mode.KeepID {
+		t.Fatalf("expected keep-id mode, got %+v (err=%v)", mode, err)
+	}
+
+	mode, err = ParseUsernsMode("auto:size=65536:map-to-root=true")
+	if err != nil {
+		t.Fatalf("ParseUsernsMode(auto): %v", err)
+	}
+	if mode.KeepID || mode.Size != 65536 || !mode.MapToRoot {
+		t.Fatalf("unexpected auto mode: %+v", mode)
+	}
+
+	if _, err := ParseUsernsMode("keep-id:size=1"); err == nil {
+		t.Fatal("expected error for keep-id with options")
+	}
+	if _, err := ParseUsernsMode("bogus"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+	if _, err := ParseUsernsMode("auto:size=not-a-number"); err == nil {
+		t.Fatal("expected error for invalid size")
+	}
+}
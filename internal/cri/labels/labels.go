@@ -85,4 +85,6 @@ const (
 	LabelSharedDiskPath = "containerd.io/snapshot/shared-disk-path"
 	// LabelUseSharedStorage is the CRI label key for use shared storage annotation
 	LabelUseSharedStorage = "containerd.io/snapshot/use-shared-storage"
+	// ContainerAttemptLabel is the CRI label key for container creation attempt annotation
+	ContainerAttemptLabel = "io.kubernetes.cri.container-attempt"
 )
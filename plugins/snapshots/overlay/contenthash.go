@@ -0,0 +1,331 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ContentDigestAlgoSHA256 is the only content digest algorithm currently
+// produced by RegisterPathMappingWithDigest.
+const ContentDigestAlgoSHA256 = "sha256"
+
+// contentHashCacheFile caches per-file digests beside the mapped snapshot's
+// fs/ directory so VerifyPathMapping doesn't need to reread files that have
+// not changed. Directory digests are not cached; they are refolded from
+// their children on every call.
+const contentHashCacheFile = ".contenthash"
+
+// dirHeader captures the directory metadata that is hashed independently
+// from its recursive content digest, mirroring BuildKit's contenthash split
+// between a path's "/dir/" header entry and its "/dir" content entry.
+type dirHeader struct {
+	Mode  uint32            `json:"mode"`
+	UID   uint32            `json:"uid"`
+	GID   uint32            `json:"gid"`
+	Xattr map[string]string `json:"xattr,omitempty"`
+}
+
+// digestCache is the sidecar file format written to contentHashCacheFile. It
+// maps each non-directory entry's on-disk path (as visited by the walk, not
+// relative to the hashed fs root) to its previously computed digest, stored
+// with a summary of the entry's lstat metadata so a changed file invalidates
+// its own cache entry.
+type digestCache struct {
+	Entries map[string]cachedDigest `json:"entries"`
+}
+
+type cachedDigest struct {
+	StatDigest string `json:"stat_digest"`
+	Digest     string `json:"digest"`
+}
+
+// RegisterPathMappingWithDigest registers a path mapping the same way
+// RegisterPathMapping does, but additionally walks basePath/podHash/snapshotHash/fs
+// and records a content digest of the tree so later calls to VerifyPathMapping
+// can detect tampering or partial corruption of the reused state directory.
+func RegisterPathMappingWithDigest(basePath, podHash, snapshotHash, namespace, podName, containerName, snapshotID string) error {
+	if err := RegisterPathMapping(basePath, podHash, snapshotHash, namespace, podName, containerName, snapshotID); err != nil {
+		return err
+	}
+	return recordContentDigest(basePath, podHash, snapshotHash)
+}
+
+// recordContentDigest computes a content digest for the mapped snapshot's
+// fs/ subtree and stores it on the mapping already registered under
+// (podHash, snapshotHash). It is the piece RegisterPathMappingWithDigest
+// shares with Commit: the upperdir has no content yet when a shared
+// snapshot's mapping is first registered (in getSharedPathBase, at Prepare
+// time), so the digest can only be computed once the snapshot is actually
+// committed.
+func recordContentDigest(basePath, podHash, snapshotHash string) error {
+	fsRoot := filepath.Join(basePath, podHash, snapshotHash, "fs")
+	digest, err := hashTree(fsRoot)
+	if err != nil {
+		return fmt.Errorf("failed to compute content digest for %s: %w", fsRoot, err)
+	}
+
+	if err := initPathMappings(basePath); err != nil {
+		return err
+	}
+
+	key := mappingKey(podHash, snapshotHash)
+	return globalStore.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMappings).Get([]byte(key))
+		if data == nil {
+			return fmt.Errorf("path mapping %s disappeared before digest could be stored", key)
+		}
+		var mapping PathMapping
+		if err := json.Unmarshal(data, &mapping); err != nil {
+			return fmt.Errorf("failed to unmarshal path mapping %s: %w", key, err)
+		}
+		mapping.ContentDigest = digest
+		mapping.ContentDigestAlgo = ContentDigestAlgoSHA256
+		return putMapping(tx, key, &mapping)
+	})
+}
+
+// VerifyPathMapping recomputes the content digest of the mapped snapshot
+// directory and compares it against the digest stored at registration time.
+// A missing fs/ directory is treated as a digest mismatch rather than an
+// error, since callers use the boolean result to decide whether the
+// directory is safe to reuse.
+func VerifyPathMapping(basePath, podHash, snapshotHash string) (bool, error) {
+	mapping, ok := LookupPathMapping(podHash, snapshotHash)
+	if !ok {
+		return false, fmt.Errorf("no path mapping for %s/%s", podHash, snapshotHash)
+	}
+	if mapping.ContentDigest == "" {
+		return false, fmt.Errorf("path mapping %s/%s has no recorded content digest", podHash, snapshotHash)
+	}
+
+	fsRoot := filepath.Join(basePath, podHash, snapshotHash, "fs")
+	if _, err := os.Stat(fsRoot); err != nil {
+		log.L.Warnf("content verification failed for %s: %v", fsRoot, err)
+		return false, nil
+	}
+
+	digest, err := hashTree(fsRoot)
+	if err != nil {
+		return false, fmt.Errorf("failed to compute content digest for %s: %w", fsRoot, err)
+	}
+
+	if digest != mapping.ContentDigest {
+		log.L.Warnf("content digest mismatch for %s: expected %s, got %s", fsRoot, mapping.ContentDigest, digest)
+		return false, nil
+	}
+	return true, nil
+}
+
+// hashTree builds an immutable radix tree over root's contents, keyed by
+// cleaned absolute path, and returns the hex-encoded root digest. Each
+// directory contributes two entries: "<dir>/" for its header (mode, uid,
+// gid, xattrs) and "<dir>" for the SHA256 of its children's digests
+// concatenated in sorted (path) order. Regular files store the SHA256 of
+// their contents; symlinks hash their target instead of following it;
+// sockets and devices hash their type and rdev.
+func hashTree(root string) (string, error) {
+	tree := iradix.New[[]byte]()
+	cache := loadDigestCache(root)
+
+	children := make(map[string][]string)
+	digests := make(map[string]string)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.Clean("/" + rel)
+
+		parent := filepath.Dir(rel)
+		if rel != "/" {
+			children[parent] = append(children[parent], rel)
+		}
+
+		header, err := statToHeader(path, info)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s for header digest: %w", path, err)
+		}
+		headerData, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		tree, _, _ = tree.Insert([]byte(rel+"/"), headerData)
+
+		if info.IsDir() {
+			return nil
+		}
+
+		digest, derr := hashEntry(path, info, cache)
+		if derr != nil {
+			return fmt.Errorf("failed to hash %s: %w", path, derr)
+		}
+		digests[rel] = digest
+		tree, _, _ = tree.Insert([]byte(rel), []byte(digest))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Fold directory content digests bottom-up: a directory's digest is the
+	// SHA256 of its children's digests, concatenated in sorted path order.
+	var dirs []string
+	for dir := range children {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		kids := children[dir]
+		sort.Strings(kids)
+		h := sha256.New()
+		for _, kid := range kids {
+			if d, ok := digests[kid]; ok {
+				h.Write([]byte(d))
+			}
+		}
+		digest := hex.EncodeToString(h.Sum(nil))
+		digests[dir] = digest
+		tree, _, _ = tree.Insert([]byte(dir), []byte(digest))
+	}
+
+	saveDigestCache(root, cache)
+
+	root64, ok := digests["/"]
+	if !ok {
+		// Empty tree: hash of no children.
+		h := sha256.New()
+		root64 = hex.EncodeToString(h.Sum(nil))
+	}
+	_ = tree // the tree is not returned or stored; only the root digest is used
+	return root64, nil
+}
+
+// hashEntry returns the content digest for a single file-like entry,
+// consulting cache for a hit keyed by the entry's current lstat metadata.
+func hashEntry(path string, info os.FileInfo, cache *digestCache) (string, error) {
+	statDigest := statDigestKey(info)
+	if entry, ok := cache.Entries[path]; ok && entry.StatDigest == statDigest {
+		return entry.Digest, nil
+	}
+
+	var digest string
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		h := sha256.Sum256([]byte(target))
+		digest = hex.EncodeToString(h[:])
+	case info.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+		var rdev uint64
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			rdev = uint64(sys.Rdev)
+		}
+		h := sha256.Sum256([]byte(fmt.Sprintf("%d-%d", info.Mode().Type(), rdev)))
+		digest = hex.EncodeToString(h[:])
+	default:
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		buf := make([]byte, 256*1024)
+		for {
+			n, rerr := f.Read(buf)
+			if n > 0 {
+				h.Write(buf[:n])
+			}
+			if rerr != nil {
+				break
+			}
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+	}
+
+	cache.Entries[path] = cachedDigest{StatDigest: statDigest, Digest: digest}
+	return digest, nil
+}
+
+// statDigestKey summarizes the parts of an entry's metadata that indicate it
+// has changed, for the purposes of the on-disk digest cache.
+func statDigestKey(info os.FileInfo) string {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%d-%d-%d-%d-%d-%d", info.Mode(), sys.Size, sys.Mtim.Sec, sys.Mtim.Nsec, sys.Rdev, sys.Ino)
+}
+
+// statToHeader extracts the directory-header fields (mode, uid, gid, xattrs)
+// for an entry's "<path>/" radix tree slot.
+func statToHeader(path string, info os.FileInfo) (*dirHeader, error) {
+	header := &dirHeader{Mode: uint32(info.Mode().Perm())}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		header.UID = sys.Uid
+		header.GID = sys.Gid
+	}
+	if xattrs, err := listXattrs(path); err == nil && len(xattrs) > 0 {
+		header.Xattr = xattrs
+	}
+	return header, nil
+}
+
+// loadDigestCache reads the sidecar cache file for root, returning an empty
+// cache if it does not exist or cannot be parsed.
+func loadDigestCache(root string) *digestCache {
+	cache := &digestCache{Entries: make(map[string]cachedDigest)}
+	data, err := os.ReadFile(filepath.Join(root, "..", contentHashCacheFile))
+	if err != nil {
+		return cache
+	}
+	_ = json.Unmarshal(data, cache)
+	return cache
+}
+
+// saveDigestCache persists cache next to root so future hashTree calls can
+// skip rehashing unchanged files.
+func saveDigestCache(root string, cache *digestCache) {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	cachePath := filepath.Join(root, "..", contentHashCacheFile)
+	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+		log.L.WithError(err).Debugf("failed to write content hash cache %s", cachePath)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containerd/log"
+)
+
+// SharedDedupMode selects how Commit deduplicates a shared snapshot's
+// upperdir contents against the canonical blob store.
+type SharedDedupMode int
+
+const (
+	// SharedDedupOff disables deduplication; Commit leaves the upperdir as-is.
+	SharedDedupOff SharedDedupMode = iota
+	// SharedDedupHardlink replaces each file with a hardlink into the blob store.
+	SharedDedupHardlink
+	// SharedDedupReflink uses FICLONE (copy-on-write reflinks) where the
+	// backing filesystem supports it, falling back to hardlink otherwise.
+	SharedDedupReflink
+	// SharedDedupAuto tries reflink first and falls back to hardlink, then
+	// to a plain copy if neither is possible (e.g. cross-device).
+	SharedDedupAuto
+)
+
+const (
+	// sharedBlobsDir is the canonical blob store directory, relative to a
+	// shared-storage root.
+	sharedBlobsDir = "blobs"
+	// blobRefSuffix names the reference-count sidecar file for a blob.
+	blobRefSuffix = ".refs"
+	// dedupChunkSize is the read buffer size used while hashing files for
+	// deduplication.
+	dedupChunkSize = 1 << 20 // 1MiB
+)
+
+// dedupRefLock serializes reference-count updates for the blob store within
+// this process. Ref-counts are incremented from Commit (inside its metastore
+// transaction) and decremented by the quota eviction sweep (outside any
+// transaction); this mutex is what keeps each read-modify-write of a
+// ".refs" file atomic.
+var dedupRefLock sync.Mutex
+
+// WithSharedDedup enables content-addressed deduplication of shared-storage
+// upperdirs on Commit, using the given mode.
+func WithSharedDedup(mode SharedDedupMode) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.sharedDedupMode = mode
+		return nil
+	}
+}
+
+// dedupUpperdir walks upperPath and replaces each regular file with a link
+// into sharedRoot/blobs/<sha256>, incrementing that blob's reference count.
+// Directories and symlinks are left in place untouched; they are cheap and
+// not worth deduplicating.
+func dedupUpperdir(sharedRoot, upperPath string, mode SharedDedupMode) error {
+	if mode == SharedDedupOff {
+		return nil
+	}
+
+	blobsDir := filepath.Join(sharedRoot, sharedBlobsDir)
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create blob store %s: %w", blobsDir, err)
+	}
+
+	return filepath.Walk(upperPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s for dedup: %w", path, err)
+		}
+
+		blobDir := filepath.Join(blobsDir, sum[:2])
+		if err := os.MkdirAll(blobDir, 0755); err != nil {
+			return fmt.Errorf("failed to create blob shard %s: %w", blobDir, err)
+		}
+		blobPath := filepath.Join(blobDir, sum)
+
+		if err := materializeBlob(blobPath, path, info); err != nil {
+			return fmt.Errorf("failed to materialize blob for %s: %w", path, err)
+		}
+
+		if err := replaceWithLink(path, blobPath, mode); err != nil {
+			log.L.WithError(err).Warnf("dedup: failed to link %s to blob %s, leaving file as-is", path, blobPath)
+			return nil
+		}
+
+		incRef(blobPath)
+		return nil
+	})
+}
+
+// materializeBlob ensures blobPath exists, copying src into it the first
+// time this content hash is seen.
+func materializeBlob(blobPath, src string, info os.FileInfo) error {
+	if _, err := os.Stat(blobPath); err == nil {
+		return nil // blob already canonicalized by a previous commit
+	}
+
+	tmp := blobPath + ".tmp"
+	if err := copyFile(src, tmp, info.Mode()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, blobPath); err != nil {
+		os.Remove(tmp)
+		if os.IsExist(err) {
+			return nil // lost the race with a concurrent commit of the same content
+		}
+		return err
+	}
+	return nil
+}
+
+// replaceWithLink replaces path with a link to blobPath: a reflink (FICLONE)
+// when requested and supported, otherwise a hardlink, falling back to
+// leaving path untouched (returning an error) when the blob lives on a
+// different device and neither linking strategy is possible.
+func replaceWithLink(path, blobPath string, mode SharedDedupMode) error {
+	tmp := path + ".dedup-tmp"
+	os.Remove(tmp)
+
+	if mode == SharedDedupReflink || mode == SharedDedupAuto {
+		if err := reflink(blobPath, tmp); err == nil {
+			return os.Rename(tmp, path)
+		}
+		os.Remove(tmp)
+	}
+
+	if err := os.Link(blobPath, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reflink creates dst as a copy-on-write clone of src via the FICLONE
+// ioctl, succeeding only on filesystems that support it (e.g. btrfs, xfs
+// with reflink=1) and when src/dst share a device.
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+}
+
+// hashFile returns the hex-encoded SHA256 of a file's contents.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := make([]byte, dedupChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile copies src to dst with the given mode, used the first time a
+// given content hash is added to the blob store.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// incRef bumps a blob's reference count, persisted in a sidecar file next
+// to it so Cleanup can tell which blobs are still referenced.
+func incRef(blobPath string) {
+	dedupRefLock.Lock()
+	defer dedupRefLock.Unlock()
+	setRefCount(blobPath, refCount(blobPath)+1)
+}
+
+// decRef drops a blob's reference count by one, returning the new count.
+func decRef(blobPath string) int {
+	dedupRefLock.Lock()
+	defer dedupRefLock.Unlock()
+	count := refCount(blobPath) - 1
+	if count < 0 {
+		count = 0
+	}
+	setRefCount(blobPath, count)
+	return count
+}
+
+// refCount reads a blob's current reference count, defaulting to 0.
+func refCount(blobPath string) int {
+	data, err := os.ReadFile(blobPath + blobRefSuffix)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// setRefCount writes a blob's reference count sidecar file.
+func setRefCount(blobPath string, count int) {
+	_ = os.WriteFile(blobPath+blobRefSuffix, []byte(strconv.Itoa(count)), 0644)
+}
+
+// decRefUpperdir walks upperPath and decrements the reference count of
+// every blob its regular files were deduplicated against, mirroring
+// dedupUpperdir's own hashing so the two stay in sync. Called just before a
+// deduplicated shared snapshot directory is actually deleted (evictOne), so
+// a later SweepUnreferencedBlobs can reclaim any blob this was the last
+// reference to. Files that were never deduplicated (refcount already 0)
+// are harmless no-ops.
+func decRefUpperdir(sharedRoot, upperPath string) error {
+	blobsDir := filepath.Join(sharedRoot, sharedBlobsDir)
+
+	return filepath.Walk(upperPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s for dedup ref release: %w", path, err)
+		}
+
+		blobPath := filepath.Join(blobsDir, sum[:2], sum)
+		decRef(blobPath)
+		return nil
+	})
+}
+
+// SweepUnreferencedBlobs deletes every blob under sharedRoot/blobs whose
+// reference count has reached zero. Intended to be called at Cleanup time.
+func SweepUnreferencedBlobs(sharedRoot string) (int, error) {
+	blobsDir := filepath.Join(sharedRoot, sharedBlobsDir)
+	removed := 0
+
+	err := filepath.Walk(blobsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == blobRefSuffix {
+			return nil
+		}
+		dedupRefLock.Lock()
+		count := refCount(path)
+		dedupRefLock.Unlock()
+
+		if count <= 0 {
+			if rmErr := os.Remove(path); rmErr == nil {
+				os.Remove(path + blobRefSuffix)
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
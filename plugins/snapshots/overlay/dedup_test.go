@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupUpperdirHardlinksAndRefcounts(t *testing.T) {
+	root := t.TempDir()
+	sharedRoot := filepath.Join(root, "shared")
+	upperA := filepath.Join(root, "upperA")
+	upperB := filepath.Join(root, "upperB")
+
+	for _, dir := range []string{upperA, upperB} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(upperA, "file.txt"), []byte("shared content"), 0644); err != nil {
+		t.Fatalf("write upperA/file.txt: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(upperB, "file.txt"), []byte("shared content"), 0644); err != nil {
+		t.Fatalf("write upperB/file.txt: %v", err)
+	}
+
+	if err := dedupUpperdir(sharedRoot, upperA, SharedDedupHardlink); err != nil {
+		t.Fatalf("dedupUpperdir upperA: %v", err)
+	}
+	if err := dedupUpperdir(sharedRoot, upperB, SharedDedupHardlink); err != nil {
+		t.Fatalf("dedupUpperdir upperB: %v", err)
+	}
+
+	sum, err := hashFile(filepath.Join(upperA, "file.txt"))
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	blobPath := filepath.Join(sharedRoot, sharedBlobsDir, sum[:2], sum)
+
+	if _, err := os.Stat(blobPath); err != nil {
+		t.Fatalf("expected blob to be materialized at %s: %v", blobPath, err)
+	}
+	if count := refCount(blobPath); count != 2 {
+		t.Fatalf("expected refcount 2 after deduping two identical files, got %d", count)
+	}
+
+	aStat, err := os.Stat(filepath.Join(upperA, "file.txt"))
+	if err != nil {
+		t.Fatalf("stat upperA/file.txt: %v", err)
+	}
+	bStat, err := os.Stat(filepath.Join(upperB, "file.txt"))
+	if err != nil {
+		t.Fatalf("stat upperB/file.txt: %v", err)
+	}
+	if !os.SameFile(aStat, bStat) {
+		t.Fatal("expected both deduped files to be hardlinked to the same blob")
+	}
+}
+
+func TestDecRefUpperdirAndSweepUnreferencedBlobs(t *testing.T) {
+	root := t.TempDir()
+	sharedRoot := filepath.Join(root, "shared")
+	upper := filepath.Join(root, "upper")
+
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		t.Fatalf("mkdir upper: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "file.txt"), []byte("solo content"), 0644); err != nil {
+		t.Fatalf("write upper/file.txt: %v", err)
+	}
+
+	if err := dedupUpperdir(sharedRoot, upper, SharedDedupHardlink); err != nil {
+		t.Fatalf("dedupUpperdir: %v", err)
+	}
+
+	sum, err := hashFile(filepath.Join(upper, "file.txt"))
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	blobPath := filepath.Join(sharedRoot, sharedBlobsDir, sum[:2], sum)
+	if count := refCount(blobPath); count != 1 {
+		t.Fatalf("expected refcount 1 before release, got %d", count)
+	}
+
+	if err := decRefUpperdir(sharedRoot, upper); err != nil {
+		t.Fatalf("decRefUpperdir: %v", err)
+	}
+	if count := refCount(blobPath); count != 0 {
+		t.Fatalf("expected refcount 0 after release, got %d", count)
+	}
+
+	removed, err := SweepUnreferencedBlobs(sharedRoot)
+	if err != nil {
+		t.Fatalf("SweepUnreferencedBlobs: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 blob swept, got %d", removed)
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Fatalf("expected blob to be removed, stat err=%v", err)
+	}
+}
+
+func TestSweepUnreferencedBlobsKeepsReferencedBlobs(t *testing.T) {
+	root := t.TempDir()
+	sharedRoot := filepath.Join(root, "shared")
+	upper := filepath.Join(root, "upper")
+
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		t.Fatalf("mkdir upper: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "file.txt"), []byte("still referenced"), 0644); err != nil {
+		t.Fatalf("write upper/file.txt: %v", err)
+	}
+	if err := dedupUpperdir(sharedRoot, upper, SharedDedupHardlink); err != nil {
+		t.Fatalf("dedupUpperdir: %v", err)
+	}
+
+	removed, err := SweepUnreferencedBlobs(sharedRoot)
+	if err != nil {
+		t.Fatalf("SweepUnreferencedBlobs: %v", err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected no blobs swept while still referenced, got %d", removed)
+	}
+}
@@ -0,0 +1,330 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// digestIndexDBFile is the bbolt database backing the cross-snapshot content
+// digest index, stored alongside metadata.db and paths.db.
+const digestIndexDBFile = "digests.db"
+
+var bucketDigestIndex = []byte("content_digests")
+
+// diffApplyStagingSuffix names the transient active snapshot ApplyDiff
+// extracts into before committing it under the caller's requested key,
+// mirroring mergeStagingSuffix in merge.go.
+const diffApplyStagingSuffix = "-apply-staging"
+
+// digestIndexEntry records where a previously committed copy of a given
+// content digest can be found, so ApplyDiff can hardlink to it instead of
+// writing the content again.
+type digestIndexEntry struct {
+	SnapshotID string `json:"snapshot_id"`
+	RelPath    string `json:"rel_path"`
+}
+
+// digestIndex is the bbolt-backed sha256 digest -> digestIndexEntry store
+// used to make ApplyDiff's cross-snapshot hardlinking possible.
+type digestIndex struct {
+	db *bolt.DB
+}
+
+// newDigestIndex opens (creating if necessary) the digest index database at
+// dbPath.
+func newDigestIndex(dbPath string) (*digestIndex, error) {
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cross-snapshot digest index %s: %w", dbPath, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketDigestIndex)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize cross-snapshot digest index: %w", err)
+	}
+	return &digestIndex{db: db}, nil
+}
+
+// lookup returns the indexed location of digest, if any.
+func (d *digestIndex) lookup(digest string) (*digestIndexEntry, bool) {
+	var entry *digestIndexEntry
+	if err := d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketDigestIndex).Get([]byte(digest))
+		if data == nil {
+			return nil
+		}
+		var e digestIndexEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		entry = &e
+		return nil
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to read cross-snapshot digest index entry for %s", digest)
+		return nil, false
+	}
+	return entry, entry != nil
+}
+
+// put records digest's location, without overwriting an existing entry: the
+// first snapshot to contribute a given digest remains its canonical source,
+// so later callers keep linking back to it instead of churning the index.
+func (d *digestIndex) put(digest string, entry *digestIndexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cross-snapshot digest index entry for %s: %w", digest, err)
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDigestIndex)
+		if b.Get([]byte(digest)) != nil {
+			return nil
+		}
+		return b.Put([]byte(digest), data)
+	})
+}
+
+// Close releases the digest index's underlying database handle.
+func (d *digestIndex) Close() error {
+	return d.db.Close()
+}
+
+// indexUpperdir walks upperPath, a newly committed snapshot's upperdir, and
+// records each regular file's content digest against snapshotID, so future
+// ApplyDiff calls can hardlink to it instead of extracting duplicate content.
+func (d *digestIndex) indexUpperdir(snapshotID, upperPath string) error {
+	return filepath.Walk(upperPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		digest, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s for digest index: %w", path, err)
+		}
+		rel, err := filepath.Rel(upperPath, path)
+		if err != nil {
+			return err
+		}
+		if err := d.put(digest, &digestIndexEntry{SnapshotID: snapshotID, RelPath: rel}); err != nil {
+			log.L.WithError(err).Warnf("failed to index %s (digest %s)", path, digest)
+		}
+		return nil
+	})
+}
+
+// ApplyDiff extracts the tar stream in reader into a fresh snapshot named
+// key and commits it, the same way a normal unpack-then-Commit flow would.
+// Regular files whose content digest is already present in the
+// cross-snapshot digest index are realized as a hardlink to that existing
+// copy instead of being written out again; ApplyDiff falls through to
+// writing the bytes when CrossSnapshotLink is disabled, the digest hasn't
+// been seen before, or linking fails (e.g. EXDEV across filesystems).
+func (o *snapshotter) ApplyDiff(ctx context.Context, key string, desc ocispec.Descriptor, reader io.Reader, opts ...snapshots.Opt) (_ ocispec.Descriptor, err error) {
+	activeKey := key + diffApplyStagingSuffix
+
+	var (
+		s         storage.Snapshot
+		finalPath string
+	)
+	defer func() {
+		if err != nil && finalPath != "" {
+			os.RemoveAll(finalPath)
+		}
+	}()
+
+	if err := o.ms.WithTransaction(ctx, true, func(ctx context.Context) (terr error) {
+		s, terr = storage.CreateSnapshot(ctx, snapshots.KindActive, activeKey, "", opts...)
+		if terr != nil {
+			return fmt.Errorf("failed to create apply-diff staging snapshot: %w", terr)
+		}
+
+		finalPath = o.getSnapshotPath(s.ID)
+		if terr := os.MkdirAll(filepath.Join(finalPath, "fs"), 0755); terr != nil {
+			return fmt.Errorf("failed to create apply-diff upperdir: %w", terr)
+		}
+		if terr := os.MkdirAll(filepath.Join(finalPath, "work"), 0711); terr != nil {
+			return fmt.Errorf("failed to create apply-diff workdir: %w", terr)
+		}
+		o.registerSnapshotPath(s.ID, filepath.Join(finalPath, "fs"), filepath.Join(finalPath, "work"))
+
+		return o.extractDiff(reader, desc.MediaType, filepath.Join(finalPath, "fs"), s.ID)
+	}); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if err := o.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		usage, uerr := fs.DiskUsage(ctx, filepath.Join(finalPath, "fs"))
+		if uerr != nil {
+			return fmt.Errorf("failed to measure applied diff %s: %w", key, uerr)
+		}
+		if _, cerr := storage.CommitActive(ctx, activeKey, key, snapshots.Usage(usage), opts...); cerr != nil {
+			return fmt.Errorf("failed to commit applied diff %s: %w", key, cerr)
+		}
+		return nil
+	}); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if o.digests != nil {
+		if ierr := o.digests.indexUpperdir(s.ID, filepath.Join(finalPath, "fs")); ierr != nil {
+			log.G(ctx).WithError(ierr).Warnf("failed to index applied diff %s for cross-snapshot linking", key)
+		}
+	}
+
+	return desc, nil
+}
+
+// extractDiff untars r (transparently gzip-decompressing when mediaType
+// indicates it) into destFS, consulting o.digests for cross-snapshot
+// hardlinking opportunities when CrossSnapshotLink is enabled.
+func (o *snapshotter) extractDiff(r io.Reader, mediaType, destFS, snapshotID string) error {
+	if strings.Contains(mediaType, "gzip") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip diff stream: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		dstPath := filepath.Join(destFS, filepath.Clean("/"+hdr.Name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dstPath, os.FileMode(hdr.Mode)&os.ModePerm); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", dstPath, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(dstPath)
+			if err := os.Symlink(hdr.Linkname, dstPath); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", dstPath, err)
+			}
+		case tar.TypeLink:
+			os.Remove(dstPath)
+			linkTarget := filepath.Join(destFS, filepath.Clean("/"+hdr.Linkname))
+			if err := os.Link(linkTarget, dstPath); err != nil {
+				return fmt.Errorf("failed to create hardlink %s: %w", dstPath, err)
+			}
+		case tar.TypeReg:
+			if err := o.extractRegularFile(tr, hdr, dstPath, snapshotID); err != nil {
+				return err
+			}
+		default:
+			log.L.Warnf("apply-diff: skipping unsupported tar entry type for %s", hdr.Name)
+		}
+
+		if err := os.Lchown(dstPath, hdr.Uid, hdr.Gid); err != nil && hdr.Typeflag != tar.TypeSymlink {
+			log.L.WithError(err).Debugf("apply-diff: failed to chown %s", dstPath)
+		}
+	}
+}
+
+// extractRegularFile materializes a single tar entry at dstPath. It always
+// reads the entry fully into a temp file (so its digest can be computed),
+// then either discards the temp file and hardlinks from an existing
+// cross-snapshot copy, or promotes the temp file into place. It does not
+// update the digest index; ApplyDiff indexes the whole upperdir after commit.
+func (o *snapshotter) extractRegularFile(tr *tar.Reader, hdr *tar.Header, dstPath, snapshotID string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory for %s: %w", dstPath, err)
+	}
+
+	tmp := dstPath + ".apply-tmp"
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(hdr.Mode)&os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+
+	h := sha256.New()
+	_, copyErr := io.Copy(io.MultiWriter(f, h), tr)
+	closeErr := f.Close()
+	if copyErr != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", dstPath, copyErr)
+	}
+	if closeErr != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to close %s: %w", tmp, closeErr)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	os.Remove(dstPath)
+
+	if o.digests != nil {
+		if entry, ok := o.digests.lookup(digest); ok && entry.SnapshotID != snapshotID {
+			srcPath := filepath.Join(o.getSnapshotFSPath(entry.SnapshotID), entry.RelPath)
+			if linkErr := os.Link(srcPath, dstPath); linkErr == nil {
+				os.Remove(tmp)
+				return nil
+			} else if !isCrossDeviceOrLinkLimit(linkErr) {
+				log.L.WithError(linkErr).Debugf("apply-diff: cross-snapshot link of %s failed, falling back to copy", dstPath)
+			}
+		}
+	}
+
+	if err := os.Rename(tmp, dstPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to place %s: %w", dstPath, err)
+	}
+
+	return nil
+}
+
+// isCrossDeviceOrLinkLimit reports whether err is an expected hardlink
+// failure: crossing devices, the link count limit, or a permission mismatch
+// under ID-mapped mounts that forbids cross-snapshot links.
+// extractRegularFile falls back to a copy on any link error, and logs only
+// those for which this returns false.
+func isCrossDeviceOrLinkLimit(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EMLINK) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDigestIndex(t *testing.T) *digestIndex {
+	t.Helper()
+	d, err := newDigestIndex(filepath.Join(t.TempDir(), digestIndexDBFile))
+	if err != nil {
+		t.Fatalf("newDigestIndex: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func tarEntry(t *testing.T, name string, content []byte) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return &buf
+}
+
+func TestExtractRegularFileLinksKnownDigestAcrossSnapshots(t *testing.T) {
+	root := t.TempDir()
+	// getSnapshotFSPath("src-id") resolves to root/snapshots/src-id/fs.
+	srcFS := filepath.Join(root, "snapshots", "src-id", "fs")
+	dstFS := filepath.Join(root, "dst", "fs")
+	for _, dir := range []string{srcFS, dstFS} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+	}
+
+	content := []byte("shared diff content")
+	if err := os.WriteFile(filepath.Join(srcFS, "file.txt"), content, 0644); err != nil {
+		t.Fatalf("write src file: %v", err)
+	}
+
+	digests := newTestDigestIndex(t)
+	digest, err := hashFile(filepath.Join(srcFS, "file.txt"))
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	if err := digests.put(digest, &digestIndexEntry{SnapshotID: "src-id", RelPath: "file.txt"}); err != nil {
+		t.Fatalf("digests.put: %v", err)
+	}
+
+	o := &snapshotter{root: root, digests: digests}
+
+	tr := tar.NewReader(tarEntry(t, "file.txt", content))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tr.Next: %v", err)
+	}
+	dstPath := filepath.Join(dstFS, "file.txt")
+	if err := o.extractRegularFile(tr, hdr, dstPath, "dst-id"); err != nil {
+		t.Fatalf("extractRegularFile: %v", err)
+	}
+
+	srcStat, err := os.Stat(filepath.Join(srcFS, "file.txt"))
+	if err != nil {
+		t.Fatalf("stat src file: %v", err)
+	}
+	dstStat, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatalf("stat dst file: %v", err)
+	}
+	if !os.SameFile(srcStat, dstStat) {
+		t.Fatal("expected extracted file to be hardlinked to the indexed cross-snapshot copy")
+	}
+	if _, err := os.Stat(dstPath + ".apply-tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be removed, stat err=%v", err)
+	}
+}
+
+func TestExtractRegularFileWritesContentWhenDigestUnknown(t *testing.T) {
+	root := t.TempDir()
+	dstFS := filepath.Join(root, "dst", "fs")
+	if err := os.MkdirAll(dstFS, 0755); err != nil {
+		t.Fatalf("mkdir %s: %v", dstFS, err)
+	}
+
+	o := &snapshotter{root: root, digests: newTestDigestIndex(t)}
+
+	content := []byte("never seen before")
+	tr := tar.NewReader(tarEntry(t, "file.txt", content))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tr.Next: %v", err)
+	}
+	dstPath := filepath.Join(dstFS, "file.txt")
+	if err := o.extractRegularFile(tr, hdr, dstPath, "dst-id"); err != nil {
+		t.Fatalf("extractRegularFile: %v", err)
+	}
+
+	got, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("read dst file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("expected extracted content %q, got %q", content, got)
+	}
+}
+
+func TestExtractRegularFileSkipsLinkingWithinSameSnapshot(t *testing.T) {
+	root := t.TempDir()
+	dstFS := filepath.Join(root, "dst", "fs")
+	if err := os.MkdirAll(dstFS, 0755); err != nil {
+		t.Fatalf("mkdir %s: %v", dstFS, err)
+	}
+
+	content := []byte("same snapshot content")
+	digests := newTestDigestIndex(t)
+	otherPath := filepath.Join(t.TempDir(), "other.txt")
+	if err := os.WriteFile(otherPath, content, 0644); err != nil {
+		t.Fatalf("write other file: %v", err)
+	}
+	digest, err := hashFile(otherPath)
+	if err != nil {
+		t.Fatalf("hashFile: %v", err)
+	}
+	if err := digests.put(digest, &digestIndexEntry{SnapshotID: "dst-id", RelPath: "other.txt"}); err != nil {
+		t.Fatalf("digests.put: %v", err)
+	}
+
+	o := &snapshotter{root: root, digests: digests}
+
+	tr := tar.NewReader(tarEntry(t, "file.txt", content))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tr.Next: %v", err)
+	}
+	dstPath := filepath.Join(dstFS, "file.txt")
+	if err := o.extractRegularFile(tr, hdr, dstPath, "dst-id"); err != nil {
+		t.Fatalf("extractRegularFile: %v", err)
+	}
+
+	got, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("read dst file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("expected extracted content %q, got %q", content, got)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+)
+
+// createUpperWorkTrees creates upperPath and workPath concurrently, chowns
+// upperPath to uid/gid if both are non-negative, and removes whichever
+// directories were created if any step fails, so a partial tree is never
+// left behind for the caller to clean up piecemeal.
+func createUpperWorkTrees(upperPath, workPath string, uid, gid int) (err error) {
+	type result struct {
+		path string
+		err  error
+	}
+
+	results := make(chan result, 2)
+	go func() {
+		results <- result{upperPath, os.MkdirAll(upperPath, 0755)}
+	}()
+	go func() {
+		results <- result{workPath, os.MkdirAll(workPath, 0711)}
+	}()
+
+	var created []string
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			err = fmt.Errorf("failed to create directory %s: %w", r.path, r.err)
+			continue
+		}
+		created = append(created, r.path)
+	}
+
+	defer func() {
+		if err != nil {
+			for _, dir := range created {
+				os.RemoveAll(dir)
+			}
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	if uid != -1 && gid != -1 {
+		if err = os.Lchown(upperPath, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", upperPath, err)
+		}
+	}
+
+	return nil
+}
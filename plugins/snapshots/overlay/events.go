@@ -0,0 +1,121 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+
+	"github.com/containerd/log"
+)
+
+// SnapshotEvent describes a lifecycle transition of a shared-storage
+// snapshot, passed to a SnapshotEventHandler.
+type SnapshotEvent struct {
+	// Key is the snapshot's key (for Prepare/Commit) or was its key before
+	// removal (for Remove/Resume).
+	Key string
+	// ID is the snapshot's internal storage ID.
+	ID string
+	// SharedPath is the resolved base directory on shared storage
+	// (basePath/podHash/snapshotHash), as returned by getSharedPathBase.
+	SharedPath string
+	// LocalPath is the resolved local snapshot directory, if any.
+	LocalPath string
+	// Labels carries the pod-identity labels (namespace, pod name,
+	// container name, and any CRI metadata) attached to the snapshot.
+	Labels map[string]string
+}
+
+// SnapshotEventHandler lets operators plug in policy for shared-storage
+// snapshot lifecycle events, in place of the snapshotter's previous
+// hard-coded "always preserve on remove" behavior. Implementations decide,
+// per snapshot, whether data at SharedPath should be preserved, archived,
+// or deleted, and are responsible for performing that action themselves;
+// the snapshotter only invokes the handler and logs/report errors it returns.
+type SnapshotEventHandler interface {
+	// OnPrepare is called after a shared-storage snapshot's directories have
+	// been created, before mounts are returned to the caller.
+	OnPrepare(ctx context.Context, event SnapshotEvent) error
+	// OnCommit is called after a shared-storage active snapshot has been
+	// committed.
+	OnCommit(ctx context.Context, event SnapshotEvent) error
+	// OnRemove is called instead of the snapshotter's own directory removal
+	// for a shared-storage snapshot's SharedPath. A handler that wants the
+	// old "always preserve" behavior should simply return nil without
+	// deleting anything.
+	OnRemove(ctx context.Context, event SnapshotEvent) error
+	// OnResume is called when a previously removed shared-storage snapshot's
+	// state directory is about to be reused by a new container (i.e. it was
+	// discovered via GetPreviousStateDirectories).
+	OnResume(ctx context.Context, event SnapshotEvent) error
+}
+
+// WithEventHandlers registers one or more SnapshotEventHandlers, invoked in
+// order for every shared-storage snapshot lifecycle transition. Handler
+// errors are logged and counted but never fail the underlying snapshotter
+// operation, since shared-storage cleanup/resume policy is inherently best
+// effort relative to the metadata transaction that already committed.
+func WithEventHandlers(handlers ...SnapshotEventHandler) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.eventHandlers = append(config.eventHandlers, handlers...)
+		return nil
+	}
+}
+
+// ResumePreviousState looks up previous shared-storage state directories for
+// the given pod identity (see GetPreviousStateDirectories) and dispatches
+// OnResume to every registered handler for each one found, letting handlers
+// react to the resume before the caller reuses the directory. Handler errors
+// are logged and counted only; every directory found is still returned.
+func (o *snapshotter) ResumePreviousState(ctx context.Context, basePath, namespace, podName, containerName string) ([]string, error) {
+	dirs, err := GetPreviousStateDirectories(basePath, namespace, podName, containerName, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(o.eventHandlers) == 0 {
+		return dirs, nil
+	}
+
+	for _, dir := range dirs {
+		event := SnapshotEvent{
+			SharedPath: dir,
+			Labels: map[string]string{
+				LabelK8sNamespace:     namespace,
+				LabelK8sPodName:       podName,
+				LabelK8sContainerName: containerName,
+			},
+		}
+		o.dispatchEvent(ctx, "resume", event, func(h SnapshotEventHandler) error {
+			return h.OnResume(ctx, event)
+		})
+	}
+	return dirs, nil
+}
+
+// dispatchEvent invokes fn for every registered handler, logging and
+// counting (via eventHandlerErrors) any error without stopping the
+// remaining handlers or failing the caller's operation.
+func (o *snapshotter) dispatchEvent(ctx context.Context, name string, event SnapshotEvent, fn func(SnapshotEventHandler) error) {
+	for _, h := range o.eventHandlers {
+		if err := fn(h); err != nil {
+			eventHandlerErrors.Inc()
+			log.G(ctx).WithError(err).WithField("handler_event", name).WithField("snapshot_id", event.ID).
+				Warn("snapshot event handler returned an error")
+		}
+	}
+}
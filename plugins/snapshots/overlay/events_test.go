@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// recordingHandler counts how many times each of its On* methods is called,
+// and optionally fails one of them, to verify dispatchEvent's
+// continue-on-error fan-out.
+type recordingHandler struct {
+	calls   int
+	failOn  string
+	failErr error
+}
+
+func (h *recordingHandler) OnPrepare(ctx context.Context, event SnapshotEvent) error {
+	h.calls++
+	if h.failOn == "prepare" {
+		return h.failErr
+	}
+	return nil
+}
+
+func (h *recordingHandler) OnCommit(ctx context.Context, event SnapshotEvent) error {
+	h.calls++
+	if h.failOn == "commit" {
+		return h.failErr
+	}
+	return nil
+}
+
+func (h *recordingHandler) OnRemove(ctx context.Context, event SnapshotEvent) error {
+	h.calls++
+	if h.failOn == "remove" {
+		return h.failErr
+	}
+	return nil
+}
+
+func (h *recordingHandler) OnResume(ctx context.Context, event SnapshotEvent) error {
+	h.calls++
+	if h.failOn == "resume" {
+		return h.failErr
+	}
+	return nil
+}
+
+func TestDispatchEventInvokesEveryHandlerDespiteErrors(t *testing.T) {
+	failing := &recordingHandler{failOn: "prepare", failErr: errors.New("boom")}
+	ok1 := &recordingHandler{}
+	ok2 := &recordingHandler{}
+	o := &snapshotter{eventHandlers: []SnapshotEventHandler{ok1, failing, ok2}}
+
+	before := eventHandlerErrors.Value()
+
+	event := SnapshotEvent{ID: "snap-1"}
+	o.dispatchEvent(context.Background(), "prepare", event, func(h SnapshotEventHandler) error {
+		return h.OnPrepare(context.Background(), event)
+	})
+
+	if ok1.calls != 1 || failing.calls != 1 || ok2.calls != 1 {
+		t.Fatalf("expected every handler to be invoked once, got ok1=%d failing=%d ok2=%d", ok1.calls, failing.calls, ok2.calls)
+	}
+	if got := eventHandlerErrors.Value() - before; got != 1 {
+		t.Fatalf("expected eventHandlerErrors to increase by 1, increased by %d", got)
+	}
+}
+
+func TestDispatchEventNoHandlersIsNoop(t *testing.T) {
+	o := &snapshotter{}
+	o.dispatchEvent(context.Background(), "commit", SnapshotEvent{}, func(h SnapshotEventHandler) error {
+		t.Fatal("fn should not be called when there are no registered handlers")
+		return nil
+	})
+}
@@ -0,0 +1,272 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// PathMappingStore is the pluggable audit/visibility backend for path
+// mappings. The bbolt-backed global store (see path_mapping.go) remains the
+// source of truth that RegisterPathMapping/LookupPathMapping/... operate
+// against; a PathMappingStore additionally mirrors the snapshotter's
+// registrations and removals (see WithPathMappingStore) so operators can
+// inspect hash->pod mappings outside the running containerd process, or
+// ship them to cluster-wide storage, without changing that hot path.
+//
+// Only the bbolt- and JSON-lines-backed implementations below exist in this
+// repository snapshot. A Redis/etcd-backed implementation for cluster-wide
+// visibility, and a small admin ttrpc/gRPC service registering
+// LookupPathMappingAdmin as a Lookup(hash) RPC, are not included here: this
+// snapshot has no client library for either store and no ttrpc/gRPC service
+// registration plumbing to hang the RPC off of. PathMappingStore is defined
+// as an interface specifically so such a backend can be added later without
+// touching the mirroring call sites in path_mapping.go.
+type PathMappingStore interface {
+	// Record mirrors a path mapping write (create or update).
+	Record(mapping *PathMapping) error
+	// Forget mirrors a path mapping removal.
+	Forget(podHash, snapshotHash string) error
+	// Lookup returns the mapping for a hash pair, for admin/debug tooling.
+	Lookup(podHash, snapshotHash string) (*PathMapping, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// WithPathMappingStore registers a PathMappingStore, in addition to the
+// existing bbolt-backed process-local store. A snapshotter configured with
+// this Opt records a shared snapshot's mapping when it is prepared, and
+// forgets it when the snapshot is removed or evicted by the quota sweep.
+// Later updates to a mapping (digest, size, access time) and removals by
+// CleanupStaleMappings or the reconciler are not mirrored.
+func WithPathMappingStore(store PathMappingStore) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.pathMappingStore = store
+		return nil
+	}
+}
+
+// boltMappingAuditStore implements PathMappingStore on top of its own bbolt
+// database, independent of the package-level singleton, so it can be
+// pointed at a separate file (e.g. shared admin storage) if desired.
+type boltMappingAuditStore struct {
+	db *bolt.DB
+}
+
+// NewBoltPathMappingStore opens (creating if necessary) a bbolt-backed
+// PathMappingStore at dbPath.
+func NewBoltPathMappingStore(dbPath string) (PathMappingStore, error) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for path mapping audit store: %w", err)
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open path mapping audit store %s: %w", dbPath, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketMappings)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltMappingAuditStore{db: db}, nil
+}
+
+func (s *boltMappingAuditStore) Record(mapping *PathMapping) error {
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	key := mappingKey(mapping.PodHash, mapping.SnapshotHash)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMappings).Put([]byte(key), data)
+	})
+}
+
+func (s *boltMappingAuditStore) Forget(podHash, snapshotHash string) error {
+	key := mappingKey(podHash, snapshotHash)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMappings).Delete([]byte(key))
+	})
+}
+
+func (s *boltMappingAuditStore) Lookup(podHash, snapshotHash string) (*PathMapping, error) {
+	key := mappingKey(podHash, snapshotHash)
+	var mapping *PathMapping
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMappings).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		var m PathMapping
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		mapping = &m
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if mapping == nil {
+		return nil, fmt.Errorf("no path mapping for %s/%s", podHash, snapshotHash)
+	}
+	return mapping, nil
+}
+
+func (s *boltMappingAuditStore) Close() error {
+	return s.db.Close()
+}
+
+// jsonlMappingAuditStore implements PathMappingStore as an append-only
+// JSON-lines file: every Record/Forget call appends an event, making it
+// suitable as a human-greppable audit trail rather than an indexed store.
+// Lookup scans the file for the most recent event affecting the key.
+type jsonlMappingAuditStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// jsonlMappingEvent is a single line in the audit log.
+type jsonlMappingEvent struct {
+	Op      string       `json:"op"` // "record" or "forget"
+	Mapping *PathMapping `json:"mapping,omitempty"`
+	Key     string       `json:"key,omitempty"`
+}
+
+// NewJSONLPathMappingStore creates (or appends to) a JSON-lines audit file at path.
+func NewJSONLPathMappingStore(path string) (PathMappingStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for path mapping audit log: %w", err)
+	}
+	return &jsonlMappingAuditStore{path: path}, nil
+}
+
+func (s *jsonlMappingAuditStore) append(event jsonlMappingEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func (s *jsonlMappingAuditStore) Record(mapping *PathMapping) error {
+	return s.append(jsonlMappingEvent{Op: "record", Mapping: mapping})
+}
+
+func (s *jsonlMappingAuditStore) Forget(podHash, snapshotHash string) error {
+	return s.append(jsonlMappingEvent{Op: "forget", Key: mappingKey(podHash, snapshotHash)})
+}
+
+func (s *jsonlMappingAuditStore) Lookup(podHash, snapshotHash string) (*PathMapping, error) {
+	key := mappingKey(podHash, snapshotHash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var latest *PathMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event jsonlMappingEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		switch event.Op {
+		case "record":
+			if event.Mapping != nil && mappingKey(event.Mapping.PodHash, event.Mapping.SnapshotHash) == key {
+				m := *event.Mapping
+				latest = &m
+			}
+		case "forget":
+			if event.Key == key {
+				latest = nil
+			}
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no path mapping for %s/%s in audit log", podHash, snapshotHash)
+	}
+	return latest, nil
+}
+
+func (s *jsonlMappingAuditStore) Close() error {
+	return nil
+}
+
+// recordToStore mirrors a just-written mapping into the snapshotter's
+// configured PathMappingStore, if any. Errors are logged, not propagated:
+// the audit mirror must never fail the registration it is mirroring.
+func (o *snapshotter) recordToStore(mapping *PathMapping) {
+	if o.pathMappingStore == nil {
+		return
+	}
+	if err := o.pathMappingStore.Record(mapping); err != nil {
+		log.L.WithError(err).Warn("failed to mirror path mapping to configured PathMappingStore")
+	}
+}
+
+// forgetFromStore mirrors a mapping removal into the snapshotter's
+// configured PathMappingStore, if any.
+func (o *snapshotter) forgetFromStore(podHash, snapshotHash string) {
+	if o.pathMappingStore == nil {
+		return
+	}
+	if err := o.pathMappingStore.Forget(podHash, snapshotHash); err != nil {
+		log.L.WithError(err).Warn("failed to mirror path mapping removal to configured PathMappingStore")
+	}
+}
+
+// LookupPathMappingAdmin resolves a hash pair back to its owning workload,
+// the operation a small admin ttrpc/gRPC service (Lookup(hash) -> (namespace,
+// pod, container, id)) would expose. It is a thin wrapper over the
+// package-level store so such a service has a single entry point to call.
+//
+// No such service is registered in this repository snapshot: this function
+// is library-only, called from nowhere here, because the ttrpc/gRPC server
+// registration this snapshotter would need to hang a service off of isn't
+// present in this tree.
+func LookupPathMappingAdmin(podHash, snapshotHash string) (namespace, podName, containerName, snapshotID string, err error) {
+	mapping, ok := LookupPathMapping(podHash, snapshotHash)
+	if !ok {
+		return "", "", "", "", fmt.Errorf("no path mapping for %s/%s", podHash, snapshotHash)
+	}
+	return mapping.Namespace, mapping.PodName, mapping.ContainerName, mapping.SnapshotID, nil
+}
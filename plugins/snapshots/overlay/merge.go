@@ -0,0 +1,259 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/log"
+)
+
+// mergeStagingSuffix names the transient active snapshot Merge creates while
+// it assembles the merged fs tree, before committing it under the caller's
+// requested key.
+const mergeStagingSuffix = "-merge-staging"
+
+// Merge produces a single committed snapshot named key whose fs directory is
+// the union of the given parents' fs directories, realized by hardlinking
+// regular files instead of copying them. Parents are merged front-to-back:
+// a file or whiteout in parents[i] shadows anything written by parents[0:i],
+// mirroring parents[len(parents)-1] being the topmost (nearest) layer if
+// this slice were instead stacked as an overlayfs lowerdir chain. This lets
+// callers collapse N layers already materialized on shared storage into a
+// single layer without an N x copy.
+//
+// Overlayfs whiteouts (0/0 character devices) and opaque directory markers
+// are replicated into the merged layer rather than resolved away, so the
+// result remains usable as a layer in its own right. Hardlinks that cross
+// devices, or that would exceed the filesystem's link count limit, fall back
+// to a plain copy.
+//
+// Merge is library-only in this repository snapshot: it is not part of the
+// snapshots.Snapshotter interface, and the CRI image-pull/layer-squash
+// plumbing that would call it to collapse shared-storage layers isn't
+// present here, so nothing in this tree invokes it yet.
+func (o *snapshotter) Merge(ctx context.Context, key string, parents []string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	parentFSPaths := make([]string, len(parents))
+	if err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		for i, p := range parents {
+			id, info, _, err := storage.GetInfo(ctx, p)
+			if err != nil {
+				return fmt.Errorf("failed to resolve merge parent %s: %w", p, err)
+			}
+			fsPath, err := o.determineUpperPath(id, info)
+			if err != nil {
+				return fmt.Errorf("failed to determine upper path for merge parent %s: %w", p, err)
+			}
+			parentFSPaths[i] = fsPath
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	activeKey := key + mergeStagingSuffix
+	xattrName := o.opaqueXattrName()
+
+	var (
+		s       storage.Snapshot
+		info    snapshots.Info
+		tempDir string
+	)
+
+	defer func() {
+		if err != nil && tempDir != "" {
+			if err1 := os.RemoveAll(tempDir); err1 != nil {
+				log.G(ctx).WithError(err1).Warn("failed to cleanup merge staging directory")
+			}
+		}
+	}()
+
+	if err := o.ms.WithTransaction(ctx, true, func(ctx context.Context) (err error) {
+		s, err = storage.CreateSnapshot(ctx, snapshots.KindActive, activeKey, "", opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create merge staging snapshot: %w", err)
+		}
+		_, info, _, err = storage.GetInfo(ctx, activeKey)
+		if err != nil {
+			return fmt.Errorf("failed to get merge staging snapshot info: %w", err)
+		}
+		for _, opt := range opts {
+			opt(&info)
+		}
+
+		tempDir, err = o.prepareDirectory(ctx, o.getSnapshotsRoot(), snapshots.KindActive)
+		if err != nil {
+			return fmt.Errorf("failed to prepare merge staging directory: %w", err)
+		}
+
+		destFS := filepath.Join(tempDir, "fs")
+		for _, parentFS := range parentFSPaths {
+			if err := mergeTreeInto(parentFS, destFS, xattrName); err != nil {
+				return fmt.Errorf("failed to merge %s into %s: %w", parentFS, destFS, err)
+			}
+		}
+
+		finalPath := o.getSnapshotPath(s.ID)
+		if err := os.Rename(tempDir, finalPath); err != nil {
+			return fmt.Errorf("failed to rename merge staging directory to %s: %w", finalPath, err)
+		}
+		tempDir = ""
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := o.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		upperPath, perr := o.determineUpperPath(s.ID, info)
+		if perr != nil {
+			return fmt.Errorf("failed to determine upper path for merged snapshot %s: %w", s.ID, perr)
+		}
+		// Every file under upperPath was hardlinked (or copied) in exactly
+		// once by mergeTreeInto, so this walk never visits the same inode
+		// twice and cannot double-count a hardlink's size.
+		usage, uerr := fs.DiskUsage(ctx, upperPath)
+		if uerr != nil {
+			return fmt.Errorf("failed to measure merged snapshot usage: %w", uerr)
+		}
+		if _, cerr := storage.CommitActive(ctx, activeKey, key, snapshots.Usage(usage), opts...); cerr != nil {
+			return fmt.Errorf("failed to commit merged snapshot %s: %w", key, cerr)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return o.Mounts(ctx, key)
+}
+
+// opaqueXattrName returns the overlayfs opaque-directory xattr name this
+// snapshotter's mounts use, depending on whether "userxattr" is configured.
+// remapIDs snapshots always use user.overlay.* (see mounts()), even when the
+// global auto-detect behind o.options didn't add "userxattr".
+func (o *snapshotter) opaqueXattrName() string {
+	if hasOption(o.options, "userxattr", false) || o.remapIDs {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// mergeTreeInto walks srcFS and applies its regular files, directories,
+// symlinks and whiteouts on top of destFS, which must already exist.
+// Entries from srcFS shadow anything already present at the same relative
+// path in destFS.
+func mergeTreeInto(srcFS, destFS, xattrName string) error {
+	return filepath.Walk(srcFS, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if srcPath == srcFS {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcFS, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(destFS, rel)
+
+		switch {
+		case isWhiteoutDevice(info):
+			if err := os.RemoveAll(dstPath); err != nil {
+				return fmt.Errorf("failed to remove %s for whiteout: %w", dstPath, err)
+			}
+			if err := makeWhiteoutDevice(dstPath); err != nil {
+				return fmt.Errorf("failed to replicate whiteout at %s: %w", dstPath, err)
+			}
+			return nil
+
+		case info.IsDir():
+			opaque := isOpaqueDir(srcPath, xattrName)
+			if opaque {
+				// This layer's directory fully replaces whatever earlier
+				// parents wrote underneath the same path.
+				if err := os.RemoveAll(dstPath); err != nil {
+					return fmt.Errorf("failed to clear %s for opaque directory: %w", dstPath, err)
+				}
+			}
+			if err := os.MkdirAll(dstPath, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", dstPath, err)
+			}
+			if opaque {
+				if err := setOpaqueDir(dstPath, xattrName); err != nil {
+					return fmt.Errorf("failed to replicate opaque marker on %s: %w", dstPath, err)
+				}
+			}
+			return chownLike(dstPath, info)
+
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
+			}
+			os.Remove(dstPath)
+			if err := os.Symlink(target, dstPath); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", dstPath, err)
+			}
+			return chownLike(dstPath, info)
+
+		case info.Mode().IsRegular():
+			os.Remove(dstPath)
+			if err := linkOrCopy(srcPath, dstPath, info); err != nil {
+				return fmt.Errorf("failed to merge file %s: %w", srcPath, err)
+			}
+			return nil
+
+		default:
+			// Other device/pipe/socket nodes are rare in image layers; skip
+			// rather than fail the whole merge over one unsupported entry.
+			log.L.Warnf("merge: skipping unsupported file type at %s", srcPath)
+			return nil
+		}
+	})
+}
+
+// linkOrCopy hardlinks src to dst, falling back to a copy when the link
+// would cross devices (EXDEV) or exceed the filesystem's link count limit
+// (EMLINK).
+func linkOrCopy(src, dst string, info os.FileInfo) error {
+	if err := os.Link(src, dst); err != nil {
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EMLINK) {
+			return copyFile(src, dst, info.Mode())
+		}
+		return err
+	}
+	return nil
+}
+
+// chownLike applies info's owner to path, matching the source entry's
+// UID/GID on the merged copy.
+func chownLike(path string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(path, int(st.Uid), int(st.Gid))
+}
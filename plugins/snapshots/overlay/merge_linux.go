@@ -0,0 +1,60 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// isWhiteoutDevice reports whether info describes an overlayfs whiteout: a
+// character device with major/minor 0/0.
+func isWhiteoutDevice(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return unix.Major(uint64(st.Rdev)) == 0 && unix.Minor(uint64(st.Rdev)) == 0
+}
+
+// makeWhiteoutDevice creates an overlayfs whiteout (a 0/0 character device)
+// at path.
+func makeWhiteoutDevice(path string) error {
+	return unix.Mknod(path, unix.S_IFCHR, 0)
+}
+
+// isOpaqueDir reports whether dir has the overlayfs opaque marker set, using
+// xattrName ("trusted.overlay.opaque" or "user.overlay.opaque" depending on
+// userxattr mode).
+func isOpaqueDir(dir, xattrName string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, xattrName, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// setOpaqueDir marks dir as opaque using xattrName, replicating the overlay
+// opaque marker onto the merged layer.
+func setOpaqueDir(dir, xattrName string) error {
+	return unix.Lsetxattr(dir, xattrName, []byte("y"), 0)
+}
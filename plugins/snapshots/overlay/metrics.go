@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import "sync/atomic"
+
+// counter is a minimal monotonic counter. It is intentionally dependency
+// free; operators who need these exported as Prometheus metrics can poll
+// Value() from their own collector.
+type counter struct {
+	value atomic.Int64
+}
+
+// Inc increments the counter by one.
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by delta.
+func (c *counter) Add(delta int64) {
+	c.value.Add(delta)
+}
+
+// Value returns the counter's current value.
+func (c *counter) Value() int64 {
+	return c.value.Load()
+}
+
+// eventHandlerErrors counts SnapshotEventHandler invocations that returned
+// an error, across every handler and event kind.
+var eventHandlerErrors counter
+
+// gauge is a minimal point-in-time value that, unlike counter, can also move
+// down (e.g. bytes currently in use). Like counter, it is dependency free.
+type gauge struct {
+	value atomic.Int64
+}
+
+// Store sets the gauge to v.
+func (g *gauge) Store(v int64) {
+	g.value.Store(v)
+}
+
+// Add adjusts the gauge by delta, which may be negative.
+func (g *gauge) Add(delta int64) {
+	g.value.Add(delta)
+}
+
+// Value returns the gauge's current value.
+func (g *gauge) Value() int64 {
+	return g.value.Load()
+}
+
+// Shared-storage quota/eviction metrics (see quota.go).
+var (
+	// sharedBytesUsed is the total on-disk size of tracked shared-storage
+	// snapshot directories, as of the last eviction sweep.
+	sharedBytesUsed gauge
+	// evictionsTotal counts shared-storage snapshots evicted by the sweep,
+	// whether for exceeding the configured quota or for EvictionTTL expiry.
+	evictionsTotal counter
+	// evictAgeSeconds accumulates the last-access age, in seconds, of every
+	// evicted snapshot, so operators can derive an average evict age.
+	evictAgeSeconds counter
+)
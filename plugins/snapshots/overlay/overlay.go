@@ -24,12 +24,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/containerd/v2/internal/cri/labels"
 	"github.com/containerd/containerd/v2/internal/userns"
 	"github.com/containerd/containerd/v2/plugins/snapshots/overlay/overlayutils"
 	"github.com/containerd/continuity/fs"
@@ -58,13 +63,22 @@ const (
 
 // SnapshotterConfig is used to configure the overlay snapshotter instance
 type SnapshotterConfig struct {
-	asyncRemove    bool
-	upperdirLabel  bool
-	ms             MetaStore
-	mountOptions   []string
-	remapIDs       bool
-	slowChown      bool
-	shortBasePaths bool // Enable short base paths for mount options optimization
+	asyncRemove              bool
+	upperdirLabel            bool
+	ms                       MetaStore
+	mountOptions             []string
+	remapIDs                 bool
+	slowChown                bool
+	shortBasePaths           bool // Enable short base paths for mount options optimization
+	eventHandlers            []SnapshotEventHandler
+	sharedDedupMode          SharedDedupMode
+	pathMappingStore         PathMappingStore
+	sharedStorageQuota       int64
+	evictionPolicy           EvictionPolicy
+	evictionTTL              time.Duration
+	evictionDryRun           bool
+	parentResolveConcurrency int
+	crossSnapshotLink        bool
 }
 
 // Opt is an option to configure the overlay snapshotter
@@ -129,6 +143,27 @@ func WithShortBasePaths(config *SnapshotterConfig) error {
 	return nil
 }
 
+// WithParentResolveConcurrency bounds how many parent snapshots mounts()
+// resolves concurrently when building its lowerdir list, instead of one at a
+// time. Prepare's UID/GID fallback stats only the first parent and does not
+// use this pool. Defaults to runtime.NumCPU(); most useful for images with
+// many layers on slow shared storage (NFS/CephFS).
+func WithParentResolveConcurrency(n int) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.parentResolveConcurrency = n
+		return nil
+	}
+}
+
+// WithCrossSnapshotLink enables ApplyDiff to hardlink tar entries from an
+// existing committed snapshot's upperdir instead of writing their contents
+// again, when an entry's content digest already appears in the index built
+// up as snapshots are committed. See difflink.go.
+func WithCrossSnapshotLink(config *SnapshotterConfig) error {
+	config.crossSnapshotLink = true
+	return nil
+}
+
 // isSharedSnapshot checks labels to see if this snapshot should use shared storage.
 func isSharedSnapshot(info snapshots.Info) bool {
 	if val, ok := info.Labels[LabelUseSharedStorage]; ok && val == "true" {
@@ -165,8 +200,22 @@ func getSharedPathBase(info snapshots.Info, id string) (string, error) {
 
 	basePath := filepath.Join(sharedDiskPath, podHash, snapshotHash)
 
-	// Register the mapping for debugging
-	if err := RegisterPathMapping(sharedDiskPath, podHash, snapshotHash, kubeNamespace, podName, containerName, id); err != nil {
+	// Register the mapping for debugging, attaching whatever CRI pod-identity
+	// metadata is available so the mapping survives pod name reuse.
+	var opts []RegisterOption
+	if podUID, ok := info.Labels[labels.SandboxUIDLabel]; ok && podUID != "" {
+		opts = append(opts, WithPodUID(podUID))
+	}
+	if sandboxID, ok := info.Labels[labels.SandboxIDLabel]; ok && sandboxID != "" {
+		opts = append(opts, WithSandboxID(sandboxID))
+	}
+	if attemptStr, ok := info.Labels[labels.ContainerAttemptLabel]; ok && attemptStr != "" {
+		if attempt, err := strconv.ParseUint(attemptStr, 10, 32); err == nil {
+			opts = append(opts, WithAttempt(uint32(attempt)))
+		}
+	}
+
+	if err := RegisterPathMapping(sharedDiskPath, podHash, snapshotHash, kubeNamespace, podName, containerName, id, opts...); err != nil {
 		log.L.WithError(err).Warnf("Failed to register path mapping for %s", basePath)
 	}
 
@@ -182,14 +231,30 @@ func hashString(s string) string {
 }
 
 type snapshotter struct {
-	root           string
-	ms             MetaStore
-	asyncRemove    bool
-	upperdirLabel  bool
-	options        []string
-	remapIDs       bool
-	slowChown      bool
-	shortBasePaths bool
+	root                     string
+	ms                       MetaStore
+	asyncRemove              bool
+	upperdirLabel            bool
+	options                  []string
+	remapIDs                 bool
+	slowChown                bool
+	shortBasePaths           bool
+	eventHandlers            []SnapshotEventHandler
+	sharedDedupMode          SharedDedupMode
+	pathMappingStore         PathMappingStore
+	sharedStorageQuota       int64
+	evictionPolicy           EvictionPolicy
+	evictionTTL              time.Duration
+	evictionDryRun           bool
+	paths                    *pathResolver
+	parentResolveConcurrency int
+	crossSnapshotLink        bool
+	digests                  *digestIndex
+	metacopySupported        bool
+
+	quotaEvictionMu     sync.Mutex
+	quotaEvictionCancel context.CancelFunc
+	quotaEvictionDone   chan struct{}
 }
 
 // NewSnapshotter returns a Snapshotter which uses overlayfs. The overlayfs
@@ -220,13 +285,32 @@ func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 		}
 	}
 
+	paths, err := newPathResolver(filepath.Join(root, pathRegistryDBFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var digests *digestIndex
+	if config.crossSnapshotLink {
+		digests, err = newDigestIndex(filepath.Join(root, digestIndexDBFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if !hasOption(config.mountOptions, "userxattr", false) {
 		// figure out whether "userxattr" option is recognized by the kernel && needed
 		userxattr, err := overlayutils.NeedsUserXAttr(root)
 		if err != nil {
 			log.L.WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
 		}
-		if userxattr {
+		// ID-mapped (remapIDs) mounts write xattrs as the mapped uid/gid, so
+		// they need the unprivileged user.overlay.* namespace even on a
+		// kernel/process that wouldn't otherwise need it; mounts() also
+		// forces "userxattr" per-mount for remapIDs snapshots, but setting
+		// it here too keeps opaqueXattrName (which reads config.mountOptions
+		// via o.options) in sync for every mount this snapshotter makes.
+		if userxattr || config.remapIDs {
 			config.mountOptions = append(config.mountOptions, "userxattr")
 		}
 	}
@@ -235,15 +319,41 @@ func NewSnapshotter(root string, opts ...Opt) (snapshots.Snapshotter, error) {
 		config.mountOptions = append(config.mountOptions, "index=off")
 	}
 
+	// metacopySupported is cached on the snapshotter and consulted again in
+	// mounts(): for remapIDs snapshots metacopy=on is opted in per-mount
+	// there (to avoid a full copy-up on every chown the uid/gid remap
+	// triggers) rather than unconditionally here.
+	metacopySupported := supportsMetacopy()
+	if !hasOption(config.mountOptions, "metacopy", true) && !config.remapIDs && metacopySupported {
+		config.mountOptions = append(config.mountOptions, "metacopy=on")
+	}
+
+	parentResolveConcurrency := config.parentResolveConcurrency
+	if parentResolveConcurrency <= 0 {
+		parentResolveConcurrency = runtime.NumCPU()
+	}
+
 	snapshotter := &snapshotter{
-		root:           root,
-		ms:             config.ms,
-		asyncRemove:    config.asyncRemove,
-		upperdirLabel:  config.upperdirLabel,
-		options:        config.mountOptions,
-		remapIDs:       config.remapIDs,
-		slowChown:      config.slowChown,
-		shortBasePaths: config.shortBasePaths,
+		root:                     root,
+		ms:                       config.ms,
+		asyncRemove:              config.asyncRemove,
+		upperdirLabel:            config.upperdirLabel,
+		options:                  config.mountOptions,
+		remapIDs:                 config.remapIDs,
+		slowChown:                config.slowChown,
+		shortBasePaths:           config.shortBasePaths,
+		eventHandlers:            config.eventHandlers,
+		sharedDedupMode:          config.sharedDedupMode,
+		pathMappingStore:         config.pathMappingStore,
+		sharedStorageQuota:       config.sharedStorageQuota,
+		evictionPolicy:           config.evictionPolicy,
+		evictionTTL:              config.evictionTTL,
+		evictionDryRun:           config.evictionDryRun,
+		paths:                    paths,
+		parentResolveConcurrency: parentResolveConcurrency,
+		crossSnapshotLink:        config.crossSnapshotLink,
+		digests:                  digests,
+		metacopySupported:        metacopySupported,
 	}
 
 	// Initialize short paths if enabled
@@ -274,14 +384,47 @@ func (o *snapshotter) getSnapshotPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id)
 }
 
-// getSnapshotFSPath returns the fs path for a snapshot
+// getSnapshotFSPath returns the fs path for a snapshot. If the path
+// registry has a record for id, it is returned directly; otherwise this
+// falls back to a one-shot probe of both the short and original path
+// layouts, registering whichever is found so subsequent calls are a plain
+// lookup. If neither layout exists yet (the snapshot is still being
+// created), it returns the path this instance would create it at.
 func (o *snapshotter) getSnapshotFSPath(id string) string {
-	return filepath.Join(o.getSnapshotPath(id), "fs")
+	fsPath, _, found := o.resolveSnapshotPaths(id)
+	if !found {
+		return filepath.Join(o.getSnapshotPath(id), "fs")
+	}
+	return fsPath
 }
 
-// getSnapshotWorkPath returns the work path for a snapshot
+// getSnapshotWorkPath returns the work path for a snapshot. See
+// getSnapshotFSPath for the registry/fallback behavior.
 func (o *snapshotter) getSnapshotWorkPath(id string) string {
-	return filepath.Join(o.getSnapshotPath(id), "work")
+	_, workPath, found := o.resolveSnapshotPaths(id)
+	if !found {
+		return filepath.Join(o.getSnapshotPath(id), "work")
+	}
+	return workPath
+}
+
+// resolveSnapshotPaths returns id's upper and work paths, preferring a
+// registered path-registry record over the one-shot stat-based fallback.
+// found is false only when neither the registry nor either on-disk layout
+// has an entry for id, e.g. because it hasn't been created yet.
+func (o *snapshotter) resolveSnapshotPaths(id string) (fsPath, workPath string, found bool) {
+	if o.paths != nil {
+		if rec, ok := o.paths.get(id); ok && rec.UpperPath != "" {
+			return rec.UpperPath, rec.WorkPath, true
+		}
+	}
+
+	if fsPath, workPath, ok := o.probeSnapshotPaths(id); ok {
+		o.registerSnapshotPath(id, fsPath, workPath)
+		return fsPath, workPath, true
+	}
+
+	return "", "", false
 }
 
 // getSnapshotsRoot returns the root directory for snapshots
@@ -459,7 +602,7 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount,
 	}); err != nil {
 		return nil, err
 	}
-	return o.mounts(s, info), nil
+	return o.mounts(s, info)
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
@@ -482,6 +625,46 @@ func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 		if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), opts...); err != nil {
 			return fmt.Errorf("failed to commit snapshot %s: %w", key, err)
 		}
+
+		var sharedBase string
+		if isSharedSnapshot(currentInfo) {
+			var baseErr error
+			sharedBase, baseErr = getSharedPathBase(currentInfo, id)
+			if baseErr != nil {
+				log.G(ctx).WithError(baseErr).Warnf("failed to resolve shared path base for dedup on commit of %s", id)
+			} else {
+				sharedRoot := filepath.Dir(filepath.Dir(sharedBase)) // strip podHash/snapshotHash back to sharedDiskPath
+				podHash, snapshotHash := filepath.Base(filepath.Dir(sharedBase)), filepath.Base(sharedBase)
+
+				if o.sharedDedupMode != SharedDedupOff {
+					if dedupErr := dedupUpperdir(sharedRoot, activeUpperPath, o.sharedDedupMode); dedupErr != nil {
+						log.G(ctx).WithError(dedupErr).Warnf("shared upperdir dedup failed for %s", id)
+					}
+				}
+				o.recordSharedUsage(ctx, podHash, snapshotHash, activeUpperPath)
+
+				// The upperdir is only fully populated now that the snapshot
+				// is committed, so the content digest GetPreviousStateDirectories
+				// verifies against can only be recorded here, not at the
+				// getSharedPathBase call inside Prepare.
+				if digestErr := recordContentDigest(sharedRoot, podHash, snapshotHash); digestErr != nil {
+					log.G(ctx).WithError(digestErr).Warnf("failed to record content digest for %s", id)
+				}
+			}
+		}
+
+		if len(o.eventHandlers) > 0 && isSharedSnapshot(currentInfo) {
+			event := SnapshotEvent{Key: name, ID: id, LocalPath: activeUpperPath, SharedPath: sharedBase, Labels: currentInfo.Labels}
+			o.dispatchEvent(ctx, "commit", event, func(h SnapshotEventHandler) error {
+				return h.OnCommit(ctx, event)
+			})
+		}
+
+		if o.digests != nil {
+			if indexErr := o.digests.indexUpperdir(id, activeUpperPath); indexErr != nil {
+				log.G(ctx).WithError(indexErr).Warnf("failed to index committed snapshot %s for cross-snapshot linking", id)
+			}
+		}
 		return nil
 	})
 }
@@ -555,15 +738,24 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 		}
 	}
 
-	// Then remove shared directory if applicable
+	// Then decide the fate of the shared directory, if applicable. With no
+	// handlers registered this preserves the previous default behavior:
+	// leave shared-storage data in place for potential notebook resume,
+	// relying on an external process (or a registered handler) to clean it
+	// up later.
 	if isDirectoryShared && sharedPathToRemove != "" {
-		log.G(ctx).Infof("Preserving shared snapshot data for potential resume. Path: %s", sharedPathToRemove)
-		// NOTE: The os.RemoveAll call is intentionally commented out to preserve the state
-		// on the shared storage for notebook resume scenarios. An external process will be
-		// responsible for the final cleanup of this directory.
-		// if errR := os.RemoveAll(sharedPathToRemove); errR != nil {
-		// 	log.G(ctx).WithError(errR).WithField("path", sharedPathToRemove).Warn("failed to remove shared directory")
-		// }
+		if len(o.eventHandlers) == 0 {
+			log.G(ctx).Infof("Preserving shared snapshot data for potential resume. Path: %s", sharedPathToRemove)
+		} else {
+			event := SnapshotEvent{Key: key, ID: id, SharedPath: sharedPathToRemove, Labels: info.Labels}
+			o.dispatchEvent(ctx, "remove", event, func(h SnapshotEventHandler) error {
+				return h.OnRemove(ctx, event)
+			})
+		}
+
+		snapshotHash := filepath.Base(sharedPathToRemove)
+		podHash := filepath.Base(filepath.Dir(sharedPathToRemove))
+		o.forgetFromStore(podHash, snapshotHash)
 	}
 	return nil
 }
@@ -610,9 +802,19 @@ func (o *snapshotter) Cleanup(ctx context.Context) error {
 	for _, dir := range cleanup {
 		if err := os.RemoveAll(dir); err != nil {
 			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+			continue
+		}
+		if o.paths != nil {
+			if err := o.paths.delete(filepath.Base(dir)); err != nil {
+				log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove snapshot path registry entry")
+			}
 		}
 	}
 
+	if err := o.evictSharedStorage(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("shared-storage quota eviction failed")
+	}
+
 	return nil
 }
 
@@ -740,32 +942,11 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		}
 		// Fallback to parent's UID/GID if not explicitly mapped and has parents
 		if (mappedUID == -1 || mappedGID == -1) && len(s.ParentIDs) > 0 {
-			// Try to find parent snapshot in multiple locations to handle path transitions
 			parentID := s.ParentIDs[0]
-			var parentUpperForStat string
-			var st os.FileInfo
-			var statErr error
-
-			// First try the current path method (short or original based on config)
-			parentUpperForStat = o.getSnapshotFSPath(parentID)
-			st, statErr = os.Stat(parentUpperForStat)
-
-			// If that failed, try the opposite path method
+			parentUpperForStat := o.getSnapshotFSPath(parentID)
+			st, statErr := os.Stat(parentUpperForStat)
 			if statErr != nil {
-				if o.shortBasePaths {
-					// If short paths are enabled but failed, try original path
-					parentUpperForStat = filepath.Join(o.root, "snapshots", parentID, "fs")
-				} else {
-					// If original paths are enabled but failed, try short path
-					containerdRoot := filepath.Dir(o.root)            // "/s/d" from "/s/d/io.containerd.snapshotter.v1.overlayfs"
-					sharedStorageBase := filepath.Dir(containerdRoot) // "/s" from "/s/d"
-					parentUpperForStat = filepath.Join(sharedStorageBase, "l", parentID, "fs")
-				}
-				st, statErr = os.Stat(parentUpperForStat)
-			}
-
-			if statErr != nil {
-				return fmt.Errorf("failed to stat parent %s for UID/GID (tried both short and original paths): %w", parentID, statErr)
+				return fmt.Errorf("failed to stat parent %s for UID/GID: %w", parentID, statErr)
 			}
 
 			if stat, ok := st.Sys().(*syscall.Stat_t); ok {
@@ -785,32 +966,11 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 			targetUpperPath := filepath.Join(sharedBase, "fs")
 			targetWorkPath := filepath.Join(sharedBase, "work")
 
-			if err = os.MkdirAll(targetUpperPath, 0755); err != nil {
-				return fmt.Errorf("failed to create shared upperdir %s: %w", targetUpperPath, err)
-			}
-			// Defer cleanup of shared upper if work creation fails
-			defer func() {
-				if err != nil { // if an error occurred later in the transaction or during work dir creation
-					os.RemoveAll(targetUpperPath)
-				}
-			}()
-			if err = os.MkdirAll(targetWorkPath, 0711); err != nil {
-				return fmt.Errorf("failed to create shared workdir %s: %w", targetWorkPath, err)
+			if err = createUpperWorkTrees(targetUpperPath, targetWorkPath, mappedUID, mappedGID); err != nil {
+				return fmt.Errorf("failed to create shared upperdir/workdir under %s: %w", sharedBase, err)
 			}
-			// Defer cleanup of shared work if something else fails
-			defer func() {
-				if err != nil {
-					os.RemoveAll(targetWorkPath)
-				}
-			}()
 
 			log.G(ctx).Debugf("Created shared upperdir at %s and workdir at %s", targetUpperPath, targetWorkPath)
-
-			if mappedUID != -1 && mappedGID != -1 {
-				if err = os.Lchown(targetUpperPath, mappedUID, mappedGID); err != nil {
-					return fmt.Errorf("failed to chown shared upperdir %s: %w", targetUpperPath, err)
-				}
-			}
 			// Ensure local snapshot ID marker directory exists
 			ensureLocalSnapshotIDDir := o.getSnapshotPath(s.ID)
 			if _, errStat := os.Stat(ensureLocalSnapshotIDDir); os.IsNotExist(errStat) {
@@ -818,6 +978,19 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 					log.G(ctx).WithError(errMk).Warnf("Failed to create local marker directory for shared snapshot %s", s.ID)
 				}
 			}
+
+			if o.pathMappingStore != nil {
+				if mapping, ok := LookupPathMapping(filepath.Base(filepath.Dir(sharedBase)), filepath.Base(sharedBase)); ok {
+					o.recordToStore(mapping)
+				}
+			}
+
+			if len(o.eventHandlers) > 0 && kind == snapshots.KindActive {
+				event := SnapshotEvent{Key: key, ID: s.ID, SharedPath: sharedBase, LocalPath: targetUpperPath, Labels: info.Labels}
+				o.dispatchEvent(ctx, "prepare", event, func(h SnapshotEventHandler) error {
+					return h.OnPrepare(ctx, event)
+				})
+			}
 		} else { // Local snapshot logic (or KindView which is always local-like)
 			localSnapshotsRootDir := o.getSnapshotsRoot()
 			localSnapshotTempDir, err = o.prepareDirectory(ctx, localSnapshotsRootDir, kind)
@@ -838,12 +1011,13 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 				return fmt.Errorf("failed to rename local snapshot dir from %s to %s: %w", localSnapshotTempDir, localSnapshotFinalPath, err)
 			}
 			localSnapshotTempDir = "" // Mark as successfully renamed
+			o.registerSnapshotPath(s.ID, filepath.Join(localSnapshotFinalPath, "fs"), filepath.Join(localSnapshotFinalPath, "work"))
 		}
 		return nil // Transaction successful
 	}); err != nil {
 		return nil, err
 	}
-	return o.mounts(s, info), nil
+	return o.mounts(s, info)
 }
 
 func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string, kind snapshots.Kind) (string, error) {
@@ -865,7 +1039,7 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 	return td, nil
 }
 
-func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) []mount.Mount {
+func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) ([]mount.Mount, error) {
 	var options []string
 	log.L.WithField("snapshotID", s.ID).WithField("kind", s.Kind).Debugf("mounts: determining mount options for snapshot")
 
@@ -899,7 +1073,7 @@ func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) []mount.Mo
 					"rbind",
 				),
 			},
-		}
+		}, nil
 	}
 
 	if s.Kind == snapshots.KindActive {
@@ -914,23 +1088,8 @@ func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) []mount.Mo
 			fmt.Sprintf("upperdir=%s", actualUpperPath),
 		)
 	} else if len(s.ParentIDs) == 1 && s.Kind == snapshots.KindView {
-		// View of a single committed layer. Try to find parent in multiple locations.
-		parentID := s.ParentIDs[0]
-
-		// First try the current path method (short or original based on config)
-		parentUpperPath := o.getSnapshotFSPath(parentID)
-		if _, err := os.Stat(parentUpperPath); err != nil {
-			// If that failed, try the opposite path method
-			if o.shortBasePaths {
-				// If short paths are enabled but failed, try original path
-				parentUpperPath = filepath.Join(o.root, "snapshots", parentID, "fs")
-			} else {
-				// If original paths are enabled but failed, try short path
-				containerdRoot := filepath.Dir(o.root)            // "/s/d" from "/s/d/io.containerd.snapshotter.v1.overlayfs"
-				sharedStorageBase := filepath.Dir(containerdRoot) // "/s" from "/s/d"
-				parentUpperPath = filepath.Join(sharedStorageBase, "l", parentID, "fs")
-			}
-		}
+		// View of a single committed layer.
+		parentUpperPath := o.getSnapshotFSPath(s.ParentIDs[0])
 
 		return []mount.Mount{
 			{
@@ -941,35 +1100,33 @@ func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) []mount.Mo
 					"rbind",
 				),
 			},
-		}
+		}, nil
 	}
 
-	parentPaths := make([]string, len(s.ParentIDs))
-	for i := range s.ParentIDs {
-		// Try to find parent snapshot in multiple locations to handle path transitions
-		parentID := s.ParentIDs[i]
-
-		// First try the current path method (short or original based on config)
-		parentPath := o.getSnapshotFSPath(parentID)
-		if _, err := os.Stat(parentPath); err != nil {
-			// If that failed, try the opposite path method
-			if o.shortBasePaths {
-				// If short paths are enabled but failed, try original path
-				parentPath = filepath.Join(o.root, "snapshots", parentID, "fs")
-			} else {
-				// If original paths are enabled but failed, try short path
-				containerdRoot := filepath.Dir(o.root)            // "/s/d" from "/s/d/io.containerd.snapshotter.v1.overlayfs"
-				sharedStorageBase := filepath.Dir(containerdRoot) // "/s" from "/s/d"
-				parentPath = filepath.Join(sharedStorageBase, "l", parentID, "fs")
-			}
-		}
-
-		parentPaths[i] = parentPath
+	parentPaths, err := o.resolveParentPaths(s.ParentIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve parent paths for snapshot %s: %w", s.ID, err)
 	}
 
 	lowerdirOption := fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":"))
 	options = append(options, lowerdirOption)
 
+	if o.remapIDs {
+		// ID-mapped mounts write whiteout/opaque xattrs as the mapped
+		// uid/gid, so trusted.overlay.* (CAP_SYS_ADMIN-gated) isn't usable;
+		// force user.overlay.* even if the global auto-detect above didn't
+		// think it was needed.
+		if !hasOption(options, "userxattr", false) && !hasOption(o.options, "userxattr", false) {
+			options = append(options, "userxattr")
+		}
+		// Opt in to metacopy=on for ID-mapped snapshots specifically: it
+		// avoids a full copy-up of file contents on every chown the
+		// uid/gid remap performs, which non-remapped mounts don't pay.
+		if o.metacopySupported && !hasOption(options, "metacopy", true) && !hasOption(o.options, "metacopy", true) {
+			options = append(options, "metacopy=on")
+		}
+	}
+
 	options = append(options, o.options...)
 
 	return []mount.Mount{
@@ -978,7 +1135,7 @@ func (o *snapshotter) mounts(s storage.Snapshot, info snapshots.Info) []mount.Mo
 			Source:  "overlay",
 			Options: options,
 		},
-	}
+	}, nil
 }
 
 // determineUpperPath resolves the correct upper directory path.
@@ -1035,6 +1192,16 @@ func (o *snapshotter) workPath(id string) string {
 
 // Close closes the snapshotter
 func (o *snapshotter) Close() error {
+	if o.paths != nil {
+		if err := o.paths.Close(); err != nil {
+			log.L.WithError(err).Warn("failed to close snapshot path registry")
+		}
+	}
+	if o.digests != nil {
+		if err := o.digests.Close(); err != nil {
+			log.L.WithError(err).Warn("failed to close cross-snapshot digest index")
+		}
+	}
 	return o.ms.Close()
 }
 
@@ -1046,6 +1213,15 @@ func supportsIndex() bool {
 	return false
 }
 
+// supportsMetacopy checks whether the "metacopy=on" option is supported by
+// the kernel, the same way supportsIndex checks for "index=off".
+func supportsMetacopy() bool {
+	if _, err := os.Stat("/sys/module/overlay/parameters/metacopy"); err == nil {
+		return true
+	}
+	return false
+}
+
 // optimizePathsMinimal attempts minimal path shortening without changing filesystem structure
 func (o *snapshotter) optimizePathsMinimal(paths []string) []string {
 	if len(paths) == 0 {
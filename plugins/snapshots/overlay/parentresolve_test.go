@@ -0,0 +1,88 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSnapshotterWithPaths(t *testing.T, concurrency int) *snapshotter {
+	t.Helper()
+	root := t.TempDir()
+	paths, err := newPathResolver(filepath.Join(root, pathRegistryDBFile))
+	if err != nil {
+		t.Fatalf("newPathResolver: %v", err)
+	}
+	t.Cleanup(func() { paths.Close() })
+	return &snapshotter{root: root, paths: paths, parentResolveConcurrency: concurrency}
+}
+
+func TestResolveParentPathsReturnsRegisteredPathsInOrder(t *testing.T) {
+	o := newTestSnapshotterWithPaths(t, 4)
+
+	o.registerSnapshotPath("id1", "/s/l/id1/fs", "/s/l/id1/work")
+	o.registerSnapshotPath("id2", "/s/l/id2/fs", "/s/l/id2/work")
+	o.registerSnapshotPath("id3", "/s/l/id3/fs", "/s/l/id3/work")
+
+	paths, err := o.resolveParentPaths([]string{"id3", "id1", "id2"})
+	if err != nil {
+		t.Fatalf("resolveParentPaths: %v", err)
+	}
+	want := []string{"/s/l/id3/fs", "/s/l/id1/fs", "/s/l/id2/fs"}
+	for i, p := range paths {
+		if p != want[i] {
+			t.Fatalf("resolveParentPaths order mismatch at %d: got %q want %q", i, p, want[i])
+		}
+	}
+}
+
+func TestResolveParentPathsAggregatesMissingIDs(t *testing.T) {
+	o := newTestSnapshotterWithPaths(t, 2)
+
+	o.registerSnapshotPath("present", "/s/l/present/fs", "/s/l/present/work")
+
+	_, err := o.resolveParentPaths([]string{"present", "missing1", "missing2"})
+	if err == nil {
+		t.Fatal("expected an error for unresolved parent ids")
+	}
+	perr, ok := err.(*parentResolveError)
+	if !ok {
+		t.Fatalf("expected *parentResolveError, got %T", err)
+	}
+	for _, id := range []string{"missing1", "missing2"} {
+		if !strings.Contains(perr.Error(), id) {
+			t.Fatalf("expected error to mention %s, got %q", id, perr.Error())
+		}
+	}
+	if strings.Contains(perr.Error(), "present") {
+		t.Fatalf("expected error to omit resolved id, got %q", perr.Error())
+	}
+}
+
+func TestResolveParentPathsEmptyInput(t *testing.T) {
+	o := newTestSnapshotterWithPaths(t, 4)
+
+	paths, err := o.resolveParentPaths(nil)
+	if err != nil {
+		t.Fatalf("resolveParentPaths(nil): %v", err)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("expected no paths for empty input, got %v", paths)
+	}
+}
@@ -17,19 +17,39 @@
 package overlay
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
 )
 
-const pathMappingFile = ".path-mappings.json"
+const (
+	// legacyPathMappingFile is the name of the pre-bbolt, whole-file JSON
+	// mapping store. It is only read once, at migration time.
+	legacyPathMappingFile = ".path-mappings.json"
+	// legacyPathMappingMigratedFile is the name the legacy file is renamed
+	// to once its entries have been imported into the bbolt store.
+	legacyPathMappingMigratedFile = ".path-mappings.json.migrated"
+	// pathMappingDBFile is the bbolt database backing the path mapping store.
+	pathMappingDBFile = ".path-mappings.db"
+)
+
+// Bucket names for the bbolt-backed path mapping store.
+var (
+	bucketMappings       = []byte("mappings")         // key -> marshaled PathMapping
+	bucketBySnapshotID   = []byte("by_snapshot_id")   // snapshot_id -> key
+	bucketByPodIdentity  = []byte("by_pod_identity")  // namespace/podName/containerName + "\x00" + key -> key
+	bucketByLastAccessed = []byte("by_last_accessed") // last_accessed (unix nano, big-endian) + key -> key
+	bucketByPodUID       = []byte("by_pod_uid")       // pod_uid + "\x00" + key -> key
+	bucketBySandboxID    = []byte("by_sandbox_id")    // sandbox_id + "\x00" + key -> key
+)
 
 // PathMapping represents a mapping between hash-based paths and original identifiers
 type PathMapping struct {
@@ -41,313 +61,575 @@ type PathMapping struct {
 	SnapshotID    string    `json:"snapshot_id"`
 	CreatedAt     time.Time `json:"created_at"`
 	LastAccessed  time.Time `json:"last_accessed"`
+	// ContentDigest is the root digest of the mapped snapshot's fs/ subtree,
+	// as computed by RegisterPathMappingWithDigest. Empty if the mapping was
+	// registered via the plain RegisterPathMapping.
+	ContentDigest string `json:"content_digest,omitempty"`
+	// ContentDigestAlgo names the algorithm used to compute ContentDigest,
+	// e.g. ContentDigestAlgoSHA256.
+	ContentDigestAlgo string `json:"content_digest_algo,omitempty"`
+	// PodUID is the Kubernetes UID of the owning pod, stable across pod
+	// re-creations that reuse the same namespace/name.
+	PodUID string `json:"pod_uid,omitempty"`
+	// SandboxID is the containerd ID of the pod sandbox container.
+	SandboxID string `json:"sandbox_id,omitempty"`
+	// Attempt is the CRI container creation attempt counter.
+	Attempt uint32 `json:"attempt,omitempty"`
+	// SizeBytes is the on-disk size of the mapped snapshot's shared
+	// directory, as last measured by the quota/eviction subsystem (see
+	// quota.go). Zero if usage tracking is disabled (no quota configured).
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+	// AccessCount counts LookupPathMapping calls against this mapping, used
+	// by the EvictionLFU policy.
+	AccessCount int64 `json:"access_count,omitempty"`
+}
+
+// RegisterOption customizes a path mapping at registration time, beyond the
+// fixed positional arguments RegisterPathMapping already takes. This keeps
+// RegisterPathMapping's signature stable for existing callers while letting
+// CRI-aware callers attach additional pod-identity metadata.
+type RegisterOption func(*PathMapping)
+
+// WithPodUID attaches the Kubernetes pod UID to a registered mapping.
+func WithPodUID(podUID string) RegisterOption {
+	return func(m *PathMapping) { m.PodUID = podUID }
+}
+
+// WithSandboxID attaches the owning sandbox's containerd ID to a registered mapping.
+func WithSandboxID(sandboxID string) RegisterOption {
+	return func(m *PathMapping) { m.SandboxID = sandboxID }
+}
+
+// WithAttempt attaches the CRI container creation attempt counter to a registered mapping.
+func WithAttempt(attempt uint32) RegisterOption {
+	return func(m *PathMapping) { m.Attempt = attempt }
 }
 
-// PathMappings holds all path mappings
-type PathMappings struct {
-	mu       sync.RWMutex
-	Mappings map[string]*PathMapping `json:"mappings"` // key is "podHash/snapshotHash"
+// legacyPathMappings mirrors the on-disk shape of the pre-bbolt JSON store,
+// used only to decode `.path-mappings.json` during migration.
+type legacyPathMappings struct {
+	Mappings map[string]*PathMapping `json:"mappings"`
+}
+
+// pathMappingStore is the process-wide handle to the bbolt-backed mapping
+// store. It replaces the old in-memory map plus whole-file JSON rewrite:
+// every operation below is a point lookup or a bounded range scan against
+// one of the secondary index buckets rather than a walk of all mappings.
+type pathMappingStore struct {
+	mu sync.Mutex // not locked anywhere; storeOnce in initPathMappings serializes open and migration
+	db *bolt.DB
+	// basePath is the shared-storage root the store was opened against,
+	// kept so later callers (e.g. quota.go's eviction sweep) that only have
+	// the process-wide store, not the original caller's basePath, can still
+	// reconstruct a mapping's on-disk directory.
+	basePath string
 }
 
 var (
-	globalMappings *PathMappings
-	mappingOnce    sync.Once
+	globalStore *pathMappingStore
+	storeOnce   sync.Once
+	storeErr    error
 )
 
-// initPathMappings initializes the global path mappings
-func initPathMappings() {
-	globalMappings = &PathMappings{
-		Mappings: make(map[string]*PathMapping),
+// initPathMappings opens (or creates) the bbolt database under basePath and,
+// on first run, migrates any legacy `.path-mappings.json` found there.
+func initPathMappings(basePath string) error {
+	storeOnce.Do(func() {
+		if err := os.MkdirAll(basePath, 0755); err != nil {
+			storeErr = fmt.Errorf("failed to create base path for path mappings: %w", err)
+			return
+		}
+
+		dbPath := filepath.Join(basePath, pathMappingDBFile)
+		db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 10 * time.Second})
+		if err != nil {
+			storeErr = fmt.Errorf("failed to open path mapping store %s: %w", dbPath, err)
+			return
+		}
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			for _, bucket := range [][]byte{bucketMappings, bucketBySnapshotID, bucketByPodIdentity, bucketByLastAccessed, bucketByPodUID, bucketBySandboxID} {
+				if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+					return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			db.Close()
+			storeErr = err
+			return
+		}
+
+		globalStore = &pathMappingStore{db: db, basePath: basePath}
+		if err := globalStore.migrateLegacy(basePath); err != nil {
+			log.L.WithError(err).Warn("failed to migrate legacy path mappings")
+		}
+	})
+	if storeErr != nil {
+		return storeErr
+	}
+
+	// Started on first initPathMappings, as documented on startReconciler;
+	// startReconciler itself is idempotent, so later calls to
+	// initPathMappings (e.g. every RegisterPathMapping) are cheap no-ops
+	// here.
+	if err := startReconciler(context.Background(), basePath); err != nil {
+		log.L.WithError(err).Warn("failed to start path mapping reconciler")
 	}
+
+	return nil
 }
 
-// RegisterPathMapping saves a mapping between hash-based paths and original identifiers
-func RegisterPathMapping(basePath, podHash, snapshotHash, namespace, podName, containerName, snapshotID string) error {
-	mappingOnce.Do(initPathMappings)
-
-	globalMappings.mu.Lock()
-	defer globalMappings.mu.Unlock()
-
-	key := fmt.Sprintf("%s/%s", podHash, snapshotHash)
-	
-	// Check if mapping already exists to preserve original created_at
-	if existing, exists := globalMappings.Mappings[key]; exists {
-		// Update existing mapping but preserve created_at
-		existing.Namespace = namespace
-		existing.PodName = podName
-		existing.ContainerName = containerName
-		existing.SnapshotID = snapshotID
-		existing.LastAccessed = time.Now()
-	} else {
-		// Create new mapping
-		globalMappings.Mappings[key] = &PathMapping{
-			PodHash:       podHash,
-			SnapshotHash:  snapshotHash,
-			Namespace:     namespace,
-			PodName:       podName,
-			ContainerName: containerName,
-			SnapshotID:    snapshotID,
-			CreatedAt:     time.Now(),
-			LastAccessed:  time.Now(),
+// migrateLegacy imports entries from the legacy `.path-mappings.json` file,
+// if present, and renames it so the import only ever runs once.
+func (s *pathMappingStore) migrateLegacy(basePath string) error {
+	legacyPath := filepath.Join(basePath, legacyPathMappingFile)
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return fmt.Errorf("failed to read legacy path mappings: %w", err)
+	}
+
+	var legacy legacyPathMappings
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to unmarshal legacy path mappings: %w", err)
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		for key, mapping := range legacy.Mappings {
+			if err := putMapping(tx, key, mapping); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to import legacy path mappings: %w", err)
+	}
+
+	if err := os.Rename(legacyPath, filepath.Join(basePath, legacyPathMappingMigratedFile)); err != nil {
+		return fmt.Errorf("failed to rename migrated legacy path mappings file: %w", err)
 	}
 
-	// Save to file
-	return savePathMappings(basePath)
+	log.L.Infof("Migrated %d legacy path mappings from %s", len(legacy.Mappings), legacyPath)
+	return nil
+}
+
+// mappingKey builds the primary key for a (podHash, snapshotHash) pair.
+func mappingKey(podHash, snapshotHash string) string {
+	return fmt.Sprintf("%s/%s", podHash, snapshotHash)
 }
 
-// savePathMappings persists the mappings to disk
-func savePathMappings(basePath string) error {
-	mappingFilePath := filepath.Join(basePath, pathMappingFile)
+// podIdentityKey builds the secondary index key for a pod identity triple.
+func podIdentityKey(namespace, podName, containerName string) string {
+	return fmt.Sprintf("%s/%s/%s", namespace, podName, containerName)
+}
+
+// lastAccessedIndexKey builds a time-ordered index key so range scans over
+// by_last_accessed return entries oldest-first.
+func lastAccessedIndexKey(t time.Time, key string) []byte {
+	buf := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	copy(buf[8:], key)
+	return buf
+}
 
-	// Ensure directory exists
-	dir := filepath.Dir(mappingFilePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory for path mappings: %w", err)
+// putMapping writes a mapping and keeps every secondary index in sync. It is
+// always called from within a writable bbolt transaction.
+func putMapping(tx *bolt.Tx, key string, mapping *PathMapping) error {
+	mb := tx.Bucket(bucketMappings)
+
+	// If replacing an existing entry, drop its stale index rows first.
+	if existing := mb.Get([]byte(key)); existing != nil {
+		var old PathMapping
+		if err := json.Unmarshal(existing, &old); err == nil {
+			removeIndexEntries(tx, key, &old)
+		}
+	}
+
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return fmt.Errorf("failed to marshal path mapping %s: %w", key, err)
+	}
+	if err := mb.Put([]byte(key), data); err != nil {
+		return fmt.Errorf("failed to store path mapping %s: %w", key, err)
 	}
 
-	// Clean up non-existent directories before saving
-	if err := cleanupNonExistentMappings(basePath); err != nil {
-		log.L.Warnf("Failed to cleanup non-existent mappings: %v", err)
+	if err := tx.Bucket(bucketBySnapshotID).Put([]byte(mapping.SnapshotID), []byte(key)); err != nil {
+		return fmt.Errorf("failed to index path mapping %s by snapshot id: %w", key, err)
 	}
 
-	// Sort mappings by snapshot_id in descending order for consistent ordering
-	sortedMappings := createSortedMappings()
+	podKey := podIdentityKey(mapping.Namespace, mapping.PodName, mapping.ContainerName)
+	pib := tx.Bucket(bucketByPodIdentity)
+	if err := pib.Put(multiIndexKey(podKey, key), []byte(key)); err != nil {
+		return fmt.Errorf("failed to index path mapping %s by pod identity: %w", key, err)
+	}
 
-	data, err := json.MarshalIndent(sortedMappings, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal path mappings: %w", err)
+	if err := tx.Bucket(bucketByLastAccessed).Put(lastAccessedIndexKey(mapping.LastAccessed, key), []byte(key)); err != nil {
+		return fmt.Errorf("failed to index path mapping %s by last accessed: %w", key, err)
 	}
 
-	// Write atomically
-	tmpFile := mappingFilePath + ".tmp"
-	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write path mappings: %w", err)
+	if mapping.PodUID != "" {
+		ib := tx.Bucket(bucketByPodUID)
+		if err := ib.Put(multiIndexKey(mapping.PodUID, key), []byte(key)); err != nil {
+			return fmt.Errorf("failed to index path mapping %s by pod uid: %w", key, err)
+		}
 	}
 
-	if err := os.Rename(tmpFile, mappingFilePath); err != nil {
-		os.Remove(tmpFile) // Clean up on error
-		return fmt.Errorf("failed to rename path mappings file: %w", err)
+	if mapping.SandboxID != "" {
+		ib := tx.Bucket(bucketBySandboxID)
+		if err := ib.Put(multiIndexKey(mapping.SandboxID, key), []byte(key)); err != nil {
+			return fmt.Errorf("failed to index path mapping %s by sandbox id: %w", key, err)
+		}
 	}
 
-	log.L.Debugf("Saved path mapping to %s", mappingFilePath)
 	return nil
 }
 
-// LoadPathMappings loads mappings from disk
-func LoadPathMappings(basePath string) error {
-	mappingOnce.Do(initPathMappings)
+// multiIndexKey builds a "value\x00key" composite key used by indices that
+// may map one value to several mapping keys (pod UID, sandbox ID, pod
+// identity), so Put/Delete never clobber a sibling entry.
+func multiIndexKey(value, key string) []byte {
+	return append([]byte(value+"\x00"), []byte(key)...)
+}
 
-	mappingFilePath := filepath.Join(basePath, pathMappingFile)
+// removeIndexEntries deletes every secondary index row pointing at key,
+// given the mapping value the row was derived from.
+func removeIndexEntries(tx *bolt.Tx, key string, mapping *PathMapping) {
+	tx.Bucket(bucketBySnapshotID).Delete([]byte(mapping.SnapshotID))
 
-	data, err := os.ReadFile(mappingFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// File doesn't exist yet, that's OK
-			log.L.Debugf("Path mappings file does not exist yet: %s", mappingFilePath)
-			return nil
-		}
-		return fmt.Errorf("failed to read path mappings: %w", err)
-	}
+	podKey := podIdentityKey(mapping.Namespace, mapping.PodName, mapping.ContainerName)
+	tx.Bucket(bucketByPodIdentity).Delete(multiIndexKey(podKey, key))
 
-	globalMappings.mu.Lock()
-	defer globalMappings.mu.Unlock()
+	tx.Bucket(bucketByLastAccessed).Delete(lastAccessedIndexKey(mapping.LastAccessed, key))
 
-	// Keep track of existing mappings count
-	existingCount := len(globalMappings.Mappings)
+	if mapping.PodUID != "" {
+		tx.Bucket(bucketByPodUID).Delete(multiIndexKey(mapping.PodUID, key))
+	}
+	if mapping.SandboxID != "" {
+		tx.Bucket(bucketBySandboxID).Delete(multiIndexKey(mapping.SandboxID, key))
+	}
+}
 
-	if err := json.Unmarshal(data, globalMappings); err != nil {
-		return fmt.Errorf("failed to unmarshal path mappings: %w", err)
+// deleteMapping removes a mapping and all of its secondary index rows.
+func deleteMapping(tx *bolt.Tx, key string) error {
+	mb := tx.Bucket(bucketMappings)
+	data := mb.Get([]byte(key))
+	if data == nil {
+		return nil
+	}
+	var mapping PathMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return fmt.Errorf("failed to unmarshal path mapping %s for deletion: %w", key, err)
 	}
+	removeIndexEntries(tx, key, &mapping)
+	return mb.Delete([]byte(key))
+}
 
-	newCount := len(globalMappings.Mappings)
-	log.L.Infof("Loaded path mappings from %s: %d mappings loaded (existing: %d, total: %d)", 
-		mappingFilePath, newCount-existingCount, existingCount, newCount)
+// RegisterPathMapping saves a mapping between hash-based paths and original
+// identifiers. Additional pod-identity metadata (pod UID, sandbox ID,
+// container attempt) can be attached via opts without disturbing this
+// function's existing positional signature.
+func RegisterPathMapping(basePath, podHash, snapshotHash, namespace, podName, containerName, snapshotID string, opts ...RegisterOption) error {
+	if err := initPathMappings(basePath); err != nil {
+		return err
+	}
 
-	return nil
+	key := mappingKey(podHash, snapshotHash)
+	now := time.Now()
+
+	return globalStore.db.Update(func(tx *bolt.Tx) error {
+		mapping := &PathMapping{
+			PodHash:       podHash,
+			SnapshotHash:  snapshotHash,
+			Namespace:     namespace,
+			PodName:       podName,
+			ContainerName: containerName,
+			SnapshotID:    snapshotID,
+			CreatedAt:     now,
+			LastAccessed:  now,
+		}
+		for _, opt := range opts {
+			opt(mapping)
+		}
+
+		// Preserve the original created_at if a mapping already exists.
+		if existing := tx.Bucket(bucketMappings).Get([]byte(key)); existing != nil {
+			var old PathMapping
+			if err := json.Unmarshal(existing, &old); err == nil {
+				mapping.CreatedAt = old.CreatedAt
+			}
+		}
+
+		return putMapping(tx, key, mapping)
+	})
+}
+
+// LoadPathMappings opens the path mapping store rooted at basePath, migrating
+// any legacy JSON mapping file found there. Safe to call multiple times.
+func LoadPathMappings(basePath string) error {
+	return initPathMappings(basePath)
 }
 
 // LookupPathMapping finds a mapping by hash-based path
 func LookupPathMapping(podHash, snapshotHash string) (*PathMapping, bool) {
-	mappingOnce.Do(initPathMappings)
+	if globalStore == nil {
+		return nil, false
+	}
 
-	globalMappings.mu.RLock()
-	defer globalMappings.mu.RUnlock()
+	key := mappingKey(podHash, snapshotHash)
+	var mapping *PathMapping
 
-	key := fmt.Sprintf("%s/%s", podHash, snapshotHash)
-	mapping, ok := globalMappings.Mappings[key]
-	if ok {
-		// Update last accessed time
-		mapping.LastAccessed = time.Now()
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMappings).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		var m PathMapping
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("failed to unmarshal path mapping %s: %w", key, err)
+		}
+		m.LastAccessed = time.Now()
+		m.AccessCount++
+		if err := putMapping(tx, key, &m); err != nil {
+			return err
+		}
+		mapping = &m
+		return nil
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to look up path mapping %s", key)
+		return nil, false
 	}
-	return mapping, ok
+
+	return mapping, mapping != nil
 }
 
-// GetAllMappings returns a copy of all mappings
-func GetAllMappings() map[string]*PathMapping {
-	mappingOnce.Do(initPathMappings)
+// UpdateMappingSize records a mapping's current on-disk size, without
+// touching its last-accessed time or access count, so periodic usage
+// measurement (see quota.go) doesn't skew LRU/LFU eviction ordering.
+func UpdateMappingSize(podHash, snapshotHash string, sizeBytes int64) error {
+	if globalStore == nil {
+		return nil
+	}
 
-	globalMappings.mu.RLock()
-	defer globalMappings.mu.RUnlock()
+	key := mappingKey(podHash, snapshotHash)
+	return globalStore.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMappings).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		var m PathMapping
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("failed to unmarshal path mapping %s: %w", key, err)
+		}
+		m.SizeBytes = sizeBytes
+		return putMapping(tx, key, &m)
+	})
+}
 
-	// Create a copy to avoid race conditions
+// forgetMapping drops a single mapping by its (podHash, snapshotHash) pair,
+// used by the quota eviction sweep once it has removed the mapping's
+// on-disk directory. A no-op if the store was never initialized.
+func forgetMapping(podHash, snapshotHash string) {
+	if globalStore == nil {
+		return
+	}
+	key := mappingKey(podHash, snapshotHash)
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		return deleteMapping(tx, key)
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to forget path mapping %s", key)
+	}
+}
+
+// GetAllMappings returns a copy of all mappings
+func GetAllMappings() map[string]*PathMapping {
 	result := make(map[string]*PathMapping)
-	for k, v := range globalMappings.Mappings {
-		// Deep copy the mapping
-		mappingCopy := *v
-		result[k] = &mappingCopy
+	if globalStore == nil {
+		return result
 	}
+
+	if err := globalStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMappings).ForEach(func(k, v []byte) error {
+			var m PathMapping
+			if err := json.Unmarshal(v, &m); err != nil {
+				return fmt.Errorf("failed to unmarshal path mapping %s: %w", k, err)
+			}
+			result[string(k)] = &m
+			return nil
+		})
+	}); err != nil {
+		log.L.WithError(err).Warn("failed to list path mappings")
+	}
+
 	return result
 }
 
-// CleanupStaleMappings removes mappings older than the specified duration
+// CleanupStaleMappings removes mappings older than the specified duration.
+// It range-scans the by_last_accessed index, which is kept in
+// oldest-first order, and stops as soon as it reaches an entry within maxAge.
 func CleanupStaleMappings(basePath string, maxAge time.Duration) error {
-	mappingOnce.Do(initPathMappings)
-
-	globalMappings.mu.Lock()
-	defer globalMappings.mu.Unlock()
+	if err := initPathMappings(basePath); err != nil {
+		return err
+	}
 
-	now := time.Now()
+	cutoff := time.Now().Add(-maxAge)
 	removed := 0
 
-	for key, mapping := range globalMappings.Mappings {
-		if now.Sub(mapping.LastAccessed) > maxAge {
-			delete(globalMappings.Mappings, key)
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketByLastAccessed).Cursor()
+		var staleKeys [][]byte
+		for idxKey, key := c.First(); idxKey != nil; idxKey, key = c.Next() {
+			accessedAt := int64(binary.BigEndian.Uint64(idxKey[:8]))
+			if time.Unix(0, accessedAt).After(cutoff) {
+				break
+			}
+			staleKeys = append(staleKeys, append([]byte(nil), key...))
+		}
+
+		for _, key := range staleKeys {
+			if err := deleteMapping(tx, string(key)); err != nil {
+				return err
+			}
 			removed++
 		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to cleanup stale path mappings: %w", err)
 	}
 
 	if removed > 0 {
 		log.L.Infof("Cleaned up %d stale path mappings", removed)
-		return savePathMappings(basePath)
 	}
-
 	return nil
 }
 
 // FindPreviousMappings finds all previous mappings for the same pod identity
 // This can be used by containers to discover previous state directories
 func FindPreviousMappings(namespace, podName, containerName string) ([]*PathMapping, error) {
-	mappingOnce.Do(initPathMappings)
-
-	globalMappings.mu.RLock()
-	defer globalMappings.mu.RUnlock()
-
-	var previousMappings []*PathMapping
-
-	for _, mapping := range globalMappings.Mappings {
-		if mapping.Namespace == namespace &&
-			mapping.PodName == podName &&
-			mapping.ContainerName == containerName {
-			// Create a copy to avoid race conditions
-			mappingCopy := *mapping
-			previousMappings = append(previousMappings, &mappingCopy)
-		}
+	mappings, err := lookupByIndex(bucketByPodIdentity, podIdentityKey(namespace, podName, containerName))
+	if err != nil {
+		return nil, err
 	}
+	sortMappingsByCreatedAtDesc(mappings)
+	return mappings, nil
+}
 
-	// Sort by creation time (newest first)
-	for i := 0; i < len(previousMappings)-1; i++ {
-		for j := i + 1; j < len(previousMappings); j++ {
-			if previousMappings[i].CreatedAt.Before(previousMappings[j].CreatedAt) {
-				previousMappings[i], previousMappings[j] = previousMappings[j], previousMappings[i]
-			}
-		}
+// LookupByPodUID returns every mapping recorded for the given Kubernetes pod
+// UID. Unlike FindPreviousMappings, this is stable across pod re-creations
+// that reuse the same namespace/name, since the UID changes on every
+// incarnation of the pod.
+func LookupByPodUID(podUID string) ([]*PathMapping, error) {
+	mappings, err := lookupByIndex(bucketByPodUID, podUID)
+	if err != nil {
+		return nil, err
 	}
-
-	return previousMappings, nil
+	sortMappingsByCreatedAtDesc(mappings)
+	return mappings, nil
 }
 
-// GetPreviousStateDirectories returns paths to previous state directories for the same pod
-func GetPreviousStateDirectories(basePath, namespace, podName, containerName string) ([]string, error) {
-	previousMappings, err := FindPreviousMappings(namespace, podName, containerName)
+// LookupBySandboxID returns every mapping recorded for containers belonging
+// to the given pod sandbox's containerd ID.
+func LookupBySandboxID(sandboxID string) ([]*PathMapping, error) {
+	mappings, err := lookupByIndex(bucketBySandboxID, sandboxID)
 	if err != nil {
 		return nil, err
 	}
+	sortMappingsByCreatedAtDesc(mappings)
+	return mappings, nil
+}
 
-	var directories []string
-	for _, mapping := range previousMappings {
-		dirPath := filepath.Join(basePath, mapping.PodHash, mapping.SnapshotHash, "fs")
-		// Check if directory exists
-		if _, err := os.Stat(dirPath); err == nil {
-			directories = append(directories, dirPath)
-		}
+// lookupByIndex range-scans one of the "value\x00key" secondary index
+// buckets for every mapping whose index value equals value.
+func lookupByIndex(bucket []byte, value string) ([]*PathMapping, error) {
+	if globalStore == nil {
+		return nil, nil
 	}
 
-	return directories, nil
-}
+	prefix := multiIndexKey(value, "")
+	var mappings []*PathMapping
 
-// cleanupNonExistentMappings removes mappings for directories that no longer exist
-func cleanupNonExistentMappings(basePath string) error {
-	var keysToRemove []string
-
-	log.L.Debugf("Starting cleanup check for %d mappings in basePath: %s", len(globalMappings.Mappings), basePath)
-
-	for key, mapping := range globalMappings.Mappings {
-		// Construct the directory path for this mapping
-		dirPath := filepath.Join(basePath, mapping.PodHash, mapping.SnapshotHash)
-		
-		// Check if the directory exists
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-			log.L.Debugf("Directory does not exist, marking for removal: %s", dirPath)
-			keysToRemove = append(keysToRemove, key)
-		} else if err != nil {
-			log.L.Debugf("Error checking directory %s: %v", dirPath, err)
-		} else {
-			log.L.Debugf("Directory exists: %s", dirPath)
+	if err := globalStore.db.View(func(tx *bolt.Tx) error {
+		mb := tx.Bucket(bucketMappings)
+		c := tx.Bucket(bucket).Cursor()
+		for idxKey, key := c.Seek(prefix); idxKey != nil && hasPrefix(idxKey, prefix); idxKey, key = c.Next() {
+			data := mb.Get(key)
+			if data == nil {
+				continue
+			}
+			var m PathMapping
+			if err := json.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("failed to unmarshal path mapping %s: %w", key, err)
+			}
+			mappings = append(mappings, &m)
 		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	// Remove the mappings for non-existent directories
-	removed := 0
-	for _, key := range keysToRemove {
-		mapping := globalMappings.Mappings[key]
-		log.L.Debugf("Removing mapping for %s (snapshot_id: %s)", key, mapping.SnapshotID)
-		delete(globalMappings.Mappings, key)
-		removed++
-	}
+	return mappings, nil
+}
 
-	if removed > 0 {
-		log.L.Infof("Cleaned up %d mappings for non-existent directories (total mappings: %d -> %d)", 
-			removed, removed+len(globalMappings.Mappings), len(globalMappings.Mappings))
+// hasPrefix reports whether b starts with prefix.
+func hasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return false
 	}
-
-	return nil
+	for i := range prefix {
+		if b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
 }
 
-// createSortedMappings creates a sorted version of the mappings for consistent JSON output
-func createSortedMappings() *PathMappings {
-	// Create a slice of mapping entries for sorting
-	type mappingEntry struct {
-		key     string
-		mapping *PathMapping
+// sortMappingsByCreatedAtDesc sorts mappings newest-first in place.
+func sortMappingsByCreatedAtDesc(mappings []*PathMapping) {
+	for i := 0; i < len(mappings)-1; i++ {
+		for j := i + 1; j < len(mappings); j++ {
+			if mappings[i].CreatedAt.Before(mappings[j].CreatedAt) {
+				mappings[i], mappings[j] = mappings[j], mappings[i]
+			}
+		}
 	}
+}
 
-	var entries []mappingEntry
-	for key, mapping := range globalMappings.Mappings {
-		entries = append(entries, mappingEntry{key: key, mapping: mapping})
+// GetPreviousStateDirectories returns paths to previous state directories for the same pod.
+// If verify is true, directories whose recorded content digest no longer
+// matches their current contents are skipped, and the skipped fs directory
+// is logged rather than returned to the caller. Only the root digest is
+// compared, so the log does not name which subtree inside it differs.
+// Mappings with no recorded digest are returned without verification.
+func GetPreviousStateDirectories(basePath, namespace, podName, containerName string, verify bool) ([]string, error) {
+	previousMappings, err := FindPreviousMappings(namespace, podName, containerName)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort by snapshot_id in descending order (newest first)
-	sort.Slice(entries, func(i, j int) bool {
-		idI, errI := strconv.ParseInt(entries[i].mapping.SnapshotID, 10, 64)
-		idJ, errJ := strconv.ParseInt(entries[j].mapping.SnapshotID, 10, 64)
-		
-		// If parsing fails, fallback to string comparison
-		if errI != nil || errJ != nil {
-			return entries[i].mapping.SnapshotID > entries[j].mapping.SnapshotID
+	var directories []string
+	for _, mapping := range previousMappings {
+		dirPath := filepath.Join(basePath, mapping.PodHash, mapping.SnapshotHash, "fs")
+		// Check if directory exists
+		if _, err := os.Stat(dirPath); err != nil {
+			continue
 		}
-		
-		return idI > idJ
-	})
 
-	// Create sorted mappings structure
-	sortedMappings := &PathMappings{
-		Mappings: make(map[string]*PathMapping),
-	}
+		if verify && mapping.ContentDigest != "" {
+			ok, verr := VerifyPathMapping(basePath, mapping.PodHash, mapping.SnapshotHash)
+			if verr != nil {
+				log.L.WithError(verr).Warnf("failed to verify content digest for %s", dirPath)
+				continue
+			}
+			if !ok {
+				log.L.Warnf("skipping previous state directory %s: content digest mismatch", dirPath)
+				continue
+			}
+		}
 
-	for _, entry := range entries {
-		sortedMappings.Mappings[entry.key] = entry.mapping
+		directories = append(directories, dirPath)
 	}
 
-	return sortedMappings
+	return directories, nil
 }
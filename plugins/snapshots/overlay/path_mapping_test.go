@@ -0,0 +1,187 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// resetPathMappingStore closes and clears the process-global path mapping
+// store and reconciler singletons, so each test gets its own bbolt database
+// under a fresh basePath instead of sharing whatever a previous test opened.
+func resetPathMappingStore(t *testing.T) {
+	t.Helper()
+	StopReconciler()
+	if globalStore != nil {
+		globalStore.db.Close()
+	}
+	globalStore = nil
+	storeOnce = sync.Once{}
+	storeErr = nil
+	t.Cleanup(func() {
+		StopReconciler()
+		if globalStore != nil {
+			globalStore.db.Close()
+		}
+		globalStore = nil
+		storeOnce = sync.Once{}
+		storeErr = nil
+	})
+}
+
+func TestRegisterAndLookupPathMapping(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	if err := RegisterPathMapping(basePath, "podhash", "snaphash", "ns", "pod", "container", "snap-id",
+		WithPodUID("pod-uid"), WithSandboxID("sandbox-id"), WithAttempt(2)); err != nil {
+		t.Fatalf("RegisterPathMapping: %v", err)
+	}
+
+	mapping, ok := LookupPathMapping("podhash", "snaphash")
+	if !ok {
+		t.Fatal("expected mapping to be found")
+	}
+	if mapping.Namespace != "ns" || mapping.PodName != "pod" || mapping.ContainerName != "container" {
+		t.Fatalf("unexpected mapping identity: %+v", mapping)
+	}
+	if mapping.PodUID != "pod-uid" || mapping.SandboxID != "sandbox-id" || mapping.Attempt != 2 {
+		t.Fatalf("unexpected mapping metadata: %+v", mapping)
+	}
+	if mapping.AccessCount != 1 {
+		t.Fatalf("expected AccessCount 1 after first lookup, got %d", mapping.AccessCount)
+	}
+
+	if _, ok := LookupPathMapping("podhash", "does-not-exist"); ok {
+		t.Fatal("expected lookup of unknown mapping to fail")
+	}
+}
+
+func TestPathMappingSecondaryIndices(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	if err := RegisterPathMapping(basePath, "podhash1", "snap1", "ns", "pod", "container", "snap-id-1",
+		WithPodUID("pod-uid"), WithSandboxID("sandbox-id")); err != nil {
+		t.Fatalf("RegisterPathMapping snap1: %v", err)
+	}
+	if err := RegisterPathMapping(basePath, "podhash1", "snap2", "ns", "pod", "container", "snap-id-2",
+		WithPodUID("pod-uid"), WithSandboxID("sandbox-id")); err != nil {
+		t.Fatalf("RegisterPathMapping snap2: %v", err)
+	}
+
+	byIdentity, err := FindPreviousMappings("ns", "pod", "container")
+	if err != nil {
+		t.Fatalf("FindPreviousMappings: %v", err)
+	}
+	if len(byIdentity) != 2 {
+		t.Fatalf("expected 2 mappings by pod identity, got %d", len(byIdentity))
+	}
+
+	byPodUID, err := LookupByPodUID("pod-uid")
+	if err != nil {
+		t.Fatalf("LookupByPodUID: %v", err)
+	}
+	if len(byPodUID) != 2 {
+		t.Fatalf("expected 2 mappings by pod uid, got %d", len(byPodUID))
+	}
+
+	bySandbox, err := LookupBySandboxID("sandbox-id")
+	if err != nil {
+		t.Fatalf("LookupBySandboxID: %v", err)
+	}
+	if len(bySandbox) != 2 {
+		t.Fatalf("expected 2 mappings by sandbox id, got %d", len(bySandbox))
+	}
+
+	// Deleting one mapping must drop it, and only it, from every index.
+	forgetMapping("podhash1", "snap1")
+
+	if byPodUID, err = LookupByPodUID("pod-uid"); err != nil || len(byPodUID) != 1 {
+		t.Fatalf("expected 1 mapping by pod uid after forget, got %d (err=%v)", len(byPodUID), err)
+	}
+	if byIdentity, err = FindPreviousMappings("ns", "pod", "container"); err != nil || len(byIdentity) != 1 {
+		t.Fatalf("expected 1 mapping by pod identity after forget, got %d (err=%v)", len(byIdentity), err)
+	}
+	if byIdentity[0].SnapshotHash != "snap2" {
+		t.Fatalf("expected remaining mapping to be snap2, got %s", byIdentity[0].SnapshotHash)
+	}
+}
+
+func TestLegacyPathMappingMigration(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	legacy := legacyPathMappings{
+		Mappings: map[string]*PathMapping{
+			"podhash/snaphash": {
+				PodHash:      "podhash",
+				SnapshotHash: "snaphash",
+				Namespace:    "ns",
+				PodName:      "pod",
+				SnapshotID:   "snap-id",
+			},
+		},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatalf("marshal legacy mappings: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(basePath, legacyPathMappingFile), data, 0644); err != nil {
+		t.Fatalf("write legacy mappings file: %v", err)
+	}
+
+	if err := LoadPathMappings(basePath); err != nil {
+		t.Fatalf("LoadPathMappings: %v", err)
+	}
+
+	mapping, ok := LookupPathMapping("podhash", "snaphash")
+	if !ok {
+		t.Fatal("expected legacy mapping to be migrated")
+	}
+	if mapping.SnapshotID != "snap-id" {
+		t.Fatalf("unexpected migrated mapping: %+v", mapping)
+	}
+
+	if _, err := os.Stat(filepath.Join(basePath, legacyPathMappingFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected legacy file to be renamed away, stat err=%v", err)
+	}
+	if _, err := os.Stat(filepath.Join(basePath, legacyPathMappingMigratedFile)); err != nil {
+		t.Fatalf("expected migrated legacy file to exist: %v", err)
+	}
+}
+
+func TestCleanupStaleMappings(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	if err := RegisterPathMapping(basePath, "podhash", "snaphash", "ns", "pod", "container", "snap-id"); err != nil {
+		t.Fatalf("RegisterPathMapping: %v", err)
+	}
+
+	if err := CleanupStaleMappings(basePath, 0); err != nil {
+		t.Fatalf("CleanupStaleMappings: %v", err)
+	}
+
+	if _, ok := LookupPathMapping("podhash", "snaphash"); ok {
+		t.Fatal("expected mapping older than maxAge=0 to be cleaned up")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pathRegistrySchemaVersion is bumped whenever snapshotPathRecord's shape
+// changes in a way that requires callers to re-probe instead of trusting a
+// stored record.
+const pathRegistrySchemaVersion = 1
+
+// pathRegistryDBFile is the bbolt database backing the snapshot path
+// registry, stored alongside metadata.db.
+const pathRegistryDBFile = "paths.db"
+
+var bucketSnapshotPaths = []byte("snapshot_paths")
+
+// snapshotPathRecord records the absolute upper/work directories chosen for
+// a local snapshot at creation time, so later lookups don't need to stat
+// both the short and original path layouts to find it.
+type snapshotPathRecord struct {
+	SchemaVersion int    `json:"schema_version"`
+	UpperPath     string `json:"upper_path"`
+	WorkPath      string `json:"work_path"`
+}
+
+// pathResolver is the bbolt-backed snapshot ID -> snapshotPathRecord store.
+type pathResolver struct {
+	db *bolt.DB
+}
+
+// newPathResolver opens (creating if necessary) the path registry database
+// at dbPath.
+func newPathResolver(dbPath string) (*pathResolver, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot path registry %s: %w", dbPath, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketSnapshotPaths)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize snapshot path registry: %w", err)
+	}
+	return &pathResolver{db: db}, nil
+}
+
+// get returns the registered path record for id, if any.
+func (r *pathResolver) get(id string) (*snapshotPathRecord, bool) {
+	var rec *snapshotPathRecord
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketSnapshotPaths).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var r snapshotPathRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		rec = &r
+		return nil
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to read snapshot path registry entry for %s", id)
+		return nil, false
+	}
+	return rec, rec != nil
+}
+
+// put writes (or overwrites) id's path record.
+func (r *pathResolver) put(id string, rec *snapshotPathRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot path registry entry for %s: %w", id, err)
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshotPaths).Put([]byte(id), data)
+	})
+}
+
+// delete removes id's path record, if any.
+func (r *pathResolver) delete(id string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnapshotPaths).Delete([]byte(id))
+	})
+}
+
+// Close releases the registry's underlying database handle.
+func (r *pathResolver) Close() error {
+	return r.db.Close()
+}
+
+// oppositeSnapshotPath returns the snapshot directory id would live at under
+// the layout opposite to the one currently configured (short vs. original
+// base paths), used only as a one-shot fallback for entries predating the
+// path registry or created under a now-changed shortBasePaths setting.
+func (o *snapshotter) oppositeSnapshotPath(id string) string {
+	if o.shortBasePaths {
+		return filepath.Join(o.root, "snapshots", id)
+	}
+	containerdRoot := filepath.Dir(o.root)            // "/s/d" from "/s/d/io.containerd.snapshotter.v1.overlayfs"
+	sharedStorageBase := filepath.Dir(containerdRoot) // "/s" from "/s/d"
+	return filepath.Join(sharedStorageBase, "l", id)
+}
+
+// probeSnapshotPaths stats id's snapshot directory under the currently
+// configured layout, falling back to the opposite layout, returning ok=false
+// if neither exists (e.g. the snapshot hasn't been created yet).
+func (o *snapshotter) probeSnapshotPaths(id string) (fsPath, workPath string, ok bool) {
+	primary := o.getSnapshotPath(id)
+	if _, err := os.Stat(filepath.Join(primary, "fs")); err == nil {
+		return filepath.Join(primary, "fs"), filepath.Join(primary, "work"), true
+	}
+
+	opposite := o.oppositeSnapshotPath(id)
+	if _, err := os.Stat(filepath.Join(opposite, "fs")); err == nil {
+		return filepath.Join(opposite, "fs"), filepath.Join(opposite, "work"), true
+	}
+
+	return "", "", false
+}
+
+// registerSnapshotPath persists a freshly created snapshot's upper/work
+// paths, logging rather than failing the caller on write error: a missing
+// registry entry only costs a one-shot probe on the next lookup.
+func (o *snapshotter) registerSnapshotPath(id, upperPath, workPath string) {
+	if o.paths == nil {
+		return
+	}
+	rec := &snapshotPathRecord{SchemaVersion: pathRegistrySchemaVersion, UpperPath: upperPath, WorkPath: workPath}
+	if err := o.paths.put(id, rec); err != nil {
+		log.L.WithError(err).Warnf("failed to register snapshot path for %s", id)
+	}
+}
+
+// Migrate re-probes and rewrites every known snapshot's path registry entry.
+// Run it after changing shortBasePaths or relocating the shared-storage
+// root, so stale registry entries pointing at a layout no longer in use
+// don't leave dangling lowerdirs after a restart.
+func (o *snapshotter) Migrate(ctx context.Context) error {
+	if o.paths == nil {
+		return nil
+	}
+
+	return o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		ids, err := storage.IDMap(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshot ids for path registry migration: %w", err)
+		}
+
+		migrated := 0
+		for id := range ids {
+			fsPath, workPath, ok := o.probeSnapshotPaths(id)
+			if !ok {
+				log.G(ctx).Warnf("path registry migration: no on-disk directory found for snapshot %s under either layout", id)
+				continue
+			}
+			if err := o.paths.put(id, &snapshotPathRecord{SchemaVersion: pathRegistrySchemaVersion, UpperPath: fsPath, WorkPath: workPath}); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to migrate path registry entry for %s", id)
+				continue
+			}
+			migrated++
+		}
+		log.G(ctx).Infof("path registry migration rewrote %d of %d snapshot entries", migrated, len(ids))
+		return nil
+	})
+}
+
+// parentResolveError aggregates the per-parent failures from
+// resolveParentPaths, so callers can report exactly which parents were
+// missing rather than failing on the first one encountered.
+type parentResolveError struct {
+	ids []string
+}
+
+func (e *parentResolveError) Error() string {
+	return fmt.Sprintf("no upper directory found under any known layout for: %s", strings.Join(e.ids, ", "))
+}
+
+// resolveParentPaths resolves the upper fs path for each of ids concurrently,
+// bounded by o.parentResolveConcurrency, preserving input order in the
+// result. It returns a *parentResolveError naming every id that couldn't be
+// found under the registry or either on-disk layout.
+func (o *snapshotter) resolveParentPaths(ids []string) ([]string, error) {
+	paths := make([]string, len(ids))
+	if len(ids) == 0 {
+		return paths, nil
+	}
+
+	concurrency := o.parentResolveConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > len(ids) {
+		concurrency = len(ids)
+	}
+
+	jobs := make(chan int)
+	missing := make([]bool, len(ids))
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fsPath, _, found := o.resolveSnapshotPaths(ids[i])
+				if !found {
+					missing[i] = true
+					continue
+				}
+				paths[i] = fsPath
+			}
+		}()
+	}
+	for i := range ids {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var missingIDs []string
+	for i, m := range missing {
+		if m {
+			missingIDs = append(missingIDs, ids[i])
+		}
+	}
+	if len(missingIDs) > 0 {
+		return nil, &parentResolveError{ids: missingIDs}
+	}
+	return paths, nil
+}
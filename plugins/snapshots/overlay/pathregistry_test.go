@@ -0,0 +1,51 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathResolverPutGetDelete(t *testing.T) {
+	root := t.TempDir()
+	paths, err := newPathResolver(filepath.Join(root, pathRegistryDBFile))
+	if err != nil {
+		t.Fatalf("newPathResolver: %v", err)
+	}
+	defer paths.Close()
+
+	rec := &snapshotPathRecord{SchemaVersion: pathRegistrySchemaVersion, UpperPath: "/s/l/id1/fs", WorkPath: "/s/l/id1/work"}
+	if err := paths.put("id1", rec); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	got, ok := paths.get("id1")
+	if !ok {
+		t.Fatal("expected record to be found")
+	}
+	if got.UpperPath != rec.UpperPath || got.WorkPath != rec.WorkPath {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+
+	if err := paths.delete("id1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, ok := paths.get("id1"); ok {
+		t.Fatal("expected record to be gone after delete")
+	}
+}
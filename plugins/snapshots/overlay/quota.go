@@ -0,0 +1,309 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/containerd/log"
+)
+
+// EvictionPolicy selects how evictSharedStorage orders orphaned shared-storage
+// snapshots for removal once usage exceeds the configured quota.
+type EvictionPolicy int
+
+const (
+	// EvictionLRU evicts the least-recently-accessed snapshot first.
+	EvictionLRU EvictionPolicy = iota
+	// EvictionLFU evicts the least-frequently-accessed snapshot first.
+	EvictionLFU
+	// EvictionTTL evicts any snapshot whose last access is older than the
+	// configured WithEvictionTTL duration, regardless of quota.
+	EvictionTTL
+	// EvictionSizeWeighted evicts the largest snapshot first, to free the
+	// most space per eviction.
+	EvictionSizeWeighted
+)
+
+// defaultEvictionInterval is how often the background eviction ticker started
+// by StartQuotaEviction sweeps for orphaned, over-quota shared snapshots.
+const defaultEvictionInterval = 10 * time.Minute
+
+// WithSharedStorageQuota caps the total size of shared-storage upperdirs
+// (summed across every pod/snapshot hash directory) at bytes. Once exceeded,
+// orphaned snapshots (their metastore key already removed, but their shared
+// directory left behind for possible resume) are evicted until usage falls
+// back under quota. A zero value, the default, disables quota enforcement.
+func WithSharedStorageQuota(bytes int64) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.sharedStorageQuota = bytes
+		return nil
+	}
+}
+
+// WithSharedEvictionPolicy selects the eviction ordering used once the
+// quota set by WithSharedStorageQuota is exceeded. Defaults to EvictionLRU.
+func WithSharedEvictionPolicy(policy EvictionPolicy) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.evictionPolicy = policy
+		return nil
+	}
+}
+
+// WithEvictionTTL sets the max-age threshold used by EvictionTTL: orphaned
+// snapshots not accessed within ttl are evicted unconditionally, independent
+// of the configured quota.
+func WithEvictionTTL(ttl time.Duration) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.evictionTTL = ttl
+		return nil
+	}
+}
+
+// WithEvictionDryRun makes evictSharedStorage only log what it would evict,
+// without removing anything. Useful for sizing a quota before enforcing it.
+func WithEvictionDryRun(config *SnapshotterConfig) error {
+	config.evictionDryRun = true
+	return nil
+}
+
+// evictionCandidate is a scoring view over a PathMapping whose shared
+// directory is eligible for eviction (its owning snapshot key is already
+// gone from the metastore).
+type evictionCandidate struct {
+	mapping *PathMapping
+	dir     string
+}
+
+// evictSharedStorage evicts orphaned shared-storage snapshots, in the order
+// given by o.evictionPolicy, until total usage falls under
+// o.sharedStorageQuota. It is a no-op if no quota is configured or the path
+// mapping store hasn't been initialized.
+func (o *snapshotter) evictSharedStorage(ctx context.Context) error {
+	if o.sharedStorageQuota <= 0 || globalStore == nil {
+		return nil
+	}
+
+	basePath := globalStore.basePath
+	if basePath == "" {
+		return nil
+	}
+
+	var liveIDs map[string]string
+	if err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		var idErr error
+		liveIDs, idErr = storage.IDMap(ctx)
+		return idErr
+	}); err != nil {
+		return fmt.Errorf("failed to list live snapshot ids for eviction: %w", err)
+	}
+
+	all := GetAllMappings()
+	var used int64
+	var candidates []evictionCandidate
+	for _, m := range all {
+		used += m.SizeBytes
+		if _, live := liveIDs[m.SnapshotID]; live {
+			continue
+		}
+		candidates = append(candidates, evictionCandidate{
+			mapping: m,
+			dir:     filepath.Join(basePath, m.PodHash, m.SnapshotHash),
+		})
+	}
+	sharedBytesUsed.Store(used)
+
+	var forced []evictionCandidate
+	if o.evictionPolicy == EvictionTTL && o.evictionTTL > 0 {
+		cutoff := time.Now().Add(-o.evictionTTL)
+		var rest []evictionCandidate
+		for _, c := range candidates {
+			if c.mapping.LastAccessed.Before(cutoff) {
+				forced = append(forced, c)
+			} else {
+				rest = append(rest, c)
+			}
+		}
+		candidates = rest
+	}
+
+	sortCandidates(candidates, o.evictionPolicy)
+
+	var evicted int
+	var freed int64
+	for _, c := range forced {
+		n, f := o.evictOne(ctx, basePath, c)
+		evicted += n
+		freed += f
+	}
+	for _, c := range candidates {
+		if used-freed <= o.sharedStorageQuota {
+			break
+		}
+		n, f := o.evictOne(ctx, basePath, c)
+		evicted += n
+		freed += f
+	}
+
+	if evicted > 0 && !o.evictionDryRun {
+		evictionsTotal.Add(int64(evicted))
+		sharedBytesUsed.Add(-freed)
+
+		if removed, sweepErr := SweepUnreferencedBlobs(basePath); sweepErr != nil {
+			log.G(ctx).WithError(sweepErr).Warn("failed to sweep unreferenced dedup blobs")
+		} else if removed > 0 {
+			log.G(ctx).Infof("swept %d unreferenced dedup blobs", removed)
+		}
+	}
+	return nil
+}
+
+// evictOne removes a single candidate's shared directory and drops its path
+// mapping, unless the snapshotter is configured for dry-run, in which case it
+// only logs what would have happened. Returns (1, size) when the directory
+// was actually removed, and (0, 0) otherwise, including in dry-run mode.
+func (o *snapshotter) evictOne(ctx context.Context, basePath string, c evictionCandidate) (int, int64) {
+	age := time.Since(c.mapping.LastAccessed)
+
+	if o.evictionDryRun {
+		log.G(ctx).Infof("[dry-run] would evict shared snapshot %s (size=%d, age=%s)", c.dir, c.mapping.SizeBytes, age)
+		return 0, 0
+	}
+
+	if o.sharedDedupMode != SharedDedupOff {
+		if err := decRefUpperdir(basePath, filepath.Join(c.dir, "fs")); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to release dedup blob references for %s", c.dir)
+		}
+	}
+
+	if err := os.RemoveAll(c.dir); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to evict shared snapshot directory %s", c.dir)
+		return 0, 0
+	}
+
+	forgetMapping(c.mapping.PodHash, c.mapping.SnapshotHash)
+	o.forgetFromStore(c.mapping.PodHash, c.mapping.SnapshotHash)
+	evictAgeSeconds.Add(int64(age.Seconds()))
+
+	log.G(ctx).Infof("evicted shared snapshot %s (size=%d, age=%s)", c.dir, c.mapping.SizeBytes, age)
+	return 1, c.mapping.SizeBytes
+}
+
+// sortCandidates orders candidates for eviction according to policy, most
+// evictable first.
+func sortCandidates(candidates []evictionCandidate, policy EvictionPolicy) {
+	switch policy {
+	case EvictionLFU:
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].mapping.AccessCount < candidates[j].mapping.AccessCount
+		})
+	case EvictionSizeWeighted:
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].mapping.SizeBytes > candidates[j].mapping.SizeBytes
+		})
+	case EvictionTTL, EvictionLRU:
+		fallthrough
+	default:
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].mapping.LastAccessed.Before(candidates[j].mapping.LastAccessed)
+		})
+	}
+}
+
+// recordSharedUsage stats dir and stores its size against the mapping keyed
+// by podHash/snapshotHash for quota accounting. It is called from Commit
+// only; Prepare and Mounts do not refresh a mapping's recorded size. It is a
+// no-op unless a quota is configured.
+func (o *snapshotter) recordSharedUsage(ctx context.Context, podHash, snapshotHash, dir string) {
+	if o.sharedStorageQuota <= 0 {
+		return
+	}
+	usage, err := fs.DiskUsage(ctx, dir)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to measure shared snapshot usage for %s", dir)
+		return
+	}
+	if err := UpdateMappingSize(podHash, snapshotHash, usage.Size); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to record shared snapshot usage for %s/%s", podHash, snapshotHash)
+	}
+}
+
+// StartQuotaEviction starts a background ticker that calls evictSharedStorage
+// every interval (defaultEvictionInterval if zero), in addition to the
+// evictSharedStorage call already made by Cleanup. The ticker's cancel/done
+// state lives on o itself, so each *snapshotter instance's eviction loop is
+// independent: calling it again on the same instance before StopQuotaEviction
+// is a no-op, but a second instance starts its own ticker rather than no-op'ing
+// against the first one's.
+func (o *snapshotter) StartQuotaEviction(ctx context.Context, interval time.Duration) {
+	if o.sharedStorageQuota <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = defaultEvictionInterval
+	}
+
+	o.quotaEvictionMu.Lock()
+	defer o.quotaEvictionMu.Unlock()
+	if o.quotaEvictionCancel != nil {
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	o.quotaEvictionCancel = cancel
+	o.quotaEvictionDone = make(chan struct{})
+
+	go func() {
+		defer close(o.quotaEvictionDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				if err := o.evictSharedStorage(runCtx); err != nil {
+					log.L.WithError(err).Warn("shared-storage quota eviction sweep failed")
+				}
+			}
+		}
+	}()
+}
+
+// StopQuotaEviction stops the ticker started by StartQuotaEviction on o, if
+// any, and blocks until its goroutine has exited.
+func (o *snapshotter) StopQuotaEviction() {
+	o.quotaEvictionMu.Lock()
+	cancel := o.quotaEvictionCancel
+	done := o.quotaEvictionDone
+	o.quotaEvictionCancel = nil
+	o.quotaEvictionDone = nil
+	o.quotaEvictionMu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSortCandidatesOrdering(t *testing.T) {
+	now := time.Now()
+	candidates := []evictionCandidate{
+		{mapping: &PathMapping{SnapshotHash: "old", LastAccessed: now.Add(-2 * time.Hour), AccessCount: 5, SizeBytes: 10}},
+		{mapping: &PathMapping{SnapshotHash: "new", LastAccessed: now, AccessCount: 1, SizeBytes: 100}},
+		{mapping: &PathMapping{SnapshotHash: "mid", LastAccessed: now.Add(-1 * time.Hour), AccessCount: 3, SizeBytes: 50}},
+	}
+
+	lru := append([]evictionCandidate{}, candidates...)
+	sortCandidates(lru, EvictionLRU)
+	if lru[0].mapping.SnapshotHash != "old" {
+		t.Fatalf("expected LRU to evict oldest first, got order %v", names(lru))
+	}
+
+	lfu := append([]evictionCandidate{}, candidates...)
+	sortCandidates(lfu, EvictionLFU)
+	if lfu[0].mapping.SnapshotHash != "new" {
+		t.Fatalf("expected LFU to evict least-accessed first, got order %v", names(lfu))
+	}
+
+	sizeWeighted := append([]evictionCandidate{}, candidates...)
+	sortCandidates(sizeWeighted, EvictionSizeWeighted)
+	if sizeWeighted[0].mapping.SnapshotHash != "new" {
+		t.Fatalf("expected size-weighted to evict largest first, got order %v", names(sizeWeighted))
+	}
+}
+
+func names(candidates []evictionCandidate) []string {
+	out := make([]string, len(candidates))
+	for i, c := range candidates {
+		out[i] = c.mapping.SnapshotHash
+	}
+	return out
+}
+
+func TestEvictOneDryRunLeavesDirectoryInPlace(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	if err := RegisterPathMapping(basePath, "podhash", "snaphash", "ns", "pod", "container", "snap-id"); err != nil {
+		t.Fatalf("RegisterPathMapping: %v", err)
+	}
+	mapping, _ := LookupPathMapping("podhash", "snaphash")
+
+	dir := filepath.Join(basePath, "podhash", "snaphash")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir %s: %v", dir, err)
+	}
+
+	o := &snapshotter{evictionDryRun: true}
+	n, freed := o.evictOne(context.Background(), basePath, evictionCandidate{mapping: mapping, dir: dir})
+	if n != 0 || freed != 0 {
+		t.Fatalf("expected dry-run evictOne to report no eviction, got n=%d freed=%d", n, freed)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected dry-run to leave directory in place: %v", err)
+	}
+	if _, ok := LookupPathMapping("podhash", "snaphash"); !ok {
+		t.Fatal("expected dry-run to leave the path mapping in place")
+	}
+}
+
+func TestEvictOneRemovesDirectoryAndMapping(t *testing.T) {
+	resetPathMappingStore(t)
+	basePath := t.TempDir()
+
+	if err := RegisterPathMapping(basePath, "podhash", "snaphash", "ns", "pod", "container", "snap-id"); err != nil {
+		t.Fatalf("RegisterPathMapping: %v", err)
+	}
+	mapping, _ := LookupPathMapping("podhash", "snaphash")
+
+	dir := filepath.Join(basePath, "podhash", "snaphash")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir %s: %v", dir, err)
+	}
+
+	o := &snapshotter{}
+	n, freed := o.evictOne(context.Background(), basePath, evictionCandidate{mapping: mapping, dir: dir})
+	if n != 1 || freed != mapping.SizeBytes {
+		t.Fatalf("expected evictOne to report 1 eviction of %d bytes, got n=%d freed=%d", mapping.SizeBytes, n, freed)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected evictOne to remove the shared directory, stat err=%v", err)
+	}
+	if _, ok := LookupPathMapping("podhash", "snaphash"); ok {
+		t.Fatal("expected evictOne to forget the path mapping")
+	}
+}
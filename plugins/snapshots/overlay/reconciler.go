@@ -0,0 +1,294 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/containerd/log"
+)
+
+const (
+	// reconcilerFallbackInterval is how often the reconciler falls back to a
+	// full os.Stat sweep of every mapping, in case fsnotify events were
+	// dropped (e.g. the watch queue overflowed).
+	reconcilerFallbackInterval = 10 * time.Minute
+)
+
+// reconciler watches a path-mapping basePath for pod/snapshot directory
+// removals so stale mappings can be dropped without stat-ing every mapping
+// on every registration.
+type reconciler struct {
+	basePath string
+	watcher  *fsnotify.Watcher
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	activeReconciler   *reconciler
+	activeReconcilerMu sync.Mutex
+)
+
+// StartReconciler starts a background goroutine that watches basePath (and
+// every basePath/<podHash> directory) for removed or renamed snapshot
+// directories, dropping the corresponding path mappings as soon as the
+// event arrives. A full fallback sweep also runs on reconcilerFallbackInterval
+// in case fsnotify drops events. Calling StartReconciler again before
+// StopReconciler is a no-op.
+func StartReconciler(ctx context.Context, basePath string) error {
+	if err := initPathMappings(basePath); err != nil {
+		return err
+	}
+	return startReconciler(ctx, basePath)
+}
+
+// startReconciler is StartReconciler's body minus the initPathMappings call,
+// split out so initPathMappings itself can start the reconciler once its
+// own store setup has already completed, without recursing back into
+// initPathMappings.
+func startReconciler(ctx context.Context, basePath string) error {
+	activeReconcilerMu.Lock()
+	defer activeReconcilerMu.Unlock()
+
+	if activeReconciler != nil {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	r := &reconciler{
+		basePath: basePath,
+		watcher:  watcher,
+		done:     make(chan struct{}),
+	}
+
+	if err := r.establishWatches(); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+
+	go r.run(runCtx)
+
+	activeReconciler = r
+	return nil
+}
+
+// StopReconciler stops the active reconciler started by StartReconciler, if
+// any, and blocks until its goroutine has exited.
+func StopReconciler() {
+	activeReconcilerMu.Lock()
+	r := activeReconciler
+	activeReconciler = nil
+	activeReconcilerMu.Unlock()
+
+	if r == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+	r.watcher.Close()
+}
+
+// establishWatches (re-)adds watches on basePath and every existing
+// basePath/<podHash> directory. Safe to call repeatedly; fsnotify ignores
+// duplicate Add calls for the same path.
+func (r *reconciler) establishWatches() error {
+	if err := r.watcher.Add(r.basePath); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(r.basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			_ = r.watcher.Add(filepath.Join(r.basePath, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// run is the reconciler's main loop: it reacts to fsnotify events as they
+// arrive and performs a periodic full sweep as a safety net.
+func (r *reconciler) run(ctx context.Context) {
+	defer close(r.done)
+
+	fallback := time.NewTicker(reconcilerFallbackInterval)
+	defer fallback.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			r.handleEvent(event)
+
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.L.WithError(err).Warn("path mapping reconciler watch error")
+
+		case <-fallback.C:
+			if err := r.sweep(); err != nil {
+				log.L.WithError(err).Warn("path mapping reconciler fallback sweep failed")
+			}
+			// basePath may have been removed and recreated since the last
+			// sweep (e.g. a shared volume remount); re-establish watches so
+			// the reconciler keeps working.
+			if err := r.establishWatches(); err != nil {
+				log.L.WithError(err).Warn("failed to re-establish path mapping watches")
+			}
+		}
+	}
+}
+
+// handleEvent drops the mapping for a removed or renamed
+// <podHash>/<snapshotHash> directory, and watches newly created podHash
+// directories so their snapshotHash children are covered too.
+func (r *reconciler) handleEvent(event fsnotify.Event) {
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() && filepath.Dir(event.Name) == r.basePath {
+			_ = r.watcher.Add(event.Name)
+		}
+		return
+	}
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return
+	}
+
+	rel, err := filepath.Rel(r.basePath, event.Name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	switch len(parts) {
+	case 1:
+		// A whole podHash directory disappeared: drop every mapping under it.
+		r.dropByPodHash(parts[0])
+	case 2:
+		// A single <podHash>/<snapshotHash> directory disappeared.
+		r.drop(mappingKey(parts[0], parts[1]))
+	}
+}
+
+// drop removes a single mapping by its primary key.
+func (r *reconciler) drop(key string) {
+	if globalStore == nil {
+		return
+	}
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		return deleteMapping(tx, key)
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to drop path mapping %s", key)
+	}
+}
+
+// dropByPodHash removes every mapping whose key is prefixed by podHash/.
+func (r *reconciler) dropByPodHash(podHash string) {
+	if globalStore == nil {
+		return
+	}
+	prefix := []byte(podHash + "/")
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketMappings).Cursor()
+		var keys []string
+		for k, _ := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		for _, key := range keys {
+			if err := deleteMapping(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.L.WithError(err).Warnf("failed to drop path mappings for pod hash %s", podHash)
+	}
+}
+
+// sweep performs a full os.Stat pass over every mapping, as a fallback for
+// fsnotify events dropped due to queue overflow. This mirrors what the
+// legacy scan-on-save cleanup did, but runs on a long interval instead of
+// on every registration.
+func (r *reconciler) sweep() error {
+	if globalStore == nil {
+		return nil
+	}
+
+	var stale []string
+	if err := globalStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMappings).ForEach(func(k, v []byte) error {
+			var m PathMapping
+			if err := json.Unmarshal(v, &m); err != nil {
+				return nil
+			}
+			dirPath := filepath.Join(r.basePath, m.PodHash, m.SnapshotHash)
+			if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	if err := globalStore.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range stale {
+			if err := deleteMapping(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	log.L.Infof("path mapping fallback sweep removed %d stale mappings", len(stale))
+	return nil
+}
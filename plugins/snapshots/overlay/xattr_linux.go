@@ -0,0 +1,68 @@
+//go:build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlay
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns every extended attribute set on path, without following
+// symlinks, keyed by attribute name.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil, err
+	}
+
+	namesBuf := make([]byte, size)
+	size, err = unix.Llistxattr(path, namesBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range splitNullTerminated(namesBuf[:size]) {
+		valSize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil || valSize <= 0 {
+			continue
+		}
+		val := make([]byte, valSize)
+		if _, err := unix.Lgetxattr(path, name, val); err != nil {
+			continue
+		}
+		xattrs[name] = string(val)
+	}
+	return xattrs, nil
+}
+
+// splitNullTerminated splits a buffer of NUL-terminated strings, as returned
+// by listxattr(2), into a slice of strings.
+func splitNullTerminated(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}